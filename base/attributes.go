@@ -0,0 +1,113 @@
+package base
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Attributes hold the key=value pairs following the labels in a
+// block's label comment, e.g. dir=/tmp/x in
+//
+//	<!-- @server timeout=30s dir=/tmp/x env=FOO=bar skip-if="! command -v docker" -->
+//
+// A key may be given more than once, e.g. env=A=1 env=B=2, so each
+// key maps to its values in the order given.
+type Attributes map[string][]string
+
+// The attributes mdrip knows.
+const (
+	// TimeoutAttr, as in timeout=30s, overrides the time a block is
+	// allowed to run, like @timeout=30s.
+	TimeoutAttr = `timeout`
+	// DirAttr names the directory in which a block runs.
+	DirAttr = `dir`
+	// EnvAttr, as in env=FOO=bar, sets an environment variable for
+	// a block.
+	EnvAttr = `env`
+	// SkipIfAttr holds a command; the block is skipped if it succeeds.
+	SkipIfAttr = `skip-if`
+	// NeedsAttr, as in needs=init,makeAdder, names the blocks that
+	// must run before a block for it to work.
+	NeedsAttr = `needs`
+	// SessionAttr names the shell a block runs in, as in
+	// session=server, for tutorials that use several terminals.
+	SessionAttr = `session`
+	// WaitPortAttr, WaitFileAttr and WaitCmdAttr name conditions to
+	// wait for once a block has run: that something listens on a
+	// port, as in wait-port=8080 or wait-port=host:8080, that a
+	// file exists, or that a command succeeds.
+	WaitPortAttr = `wait-port`
+	WaitFileAttr = `wait-file`
+	WaitCmdAttr  = `wait-cmd`
+	// WaitTimeoutAttr and WaitIntervalAttr say how long to wait for
+	// each condition, and how often to check it, e.g. wait-timeout=1m
+	// wait-interval=2s.
+	WaitTimeoutAttr  = `wait-timeout`
+	WaitIntervalAttr = `wait-interval`
+)
+
+var knownAttrs = map[string]bool{
+	TimeoutAttr:      true,
+	DirAttr:          true,
+	EnvAttr:          true,
+	SkipIfAttr:       true,
+	NeedsAttr:        true,
+	SessionAttr:      true,
+	WaitPortAttr:     true,
+	WaitFileAttr:     true,
+	WaitCmdAttr:      true,
+	WaitTimeoutAttr:  true,
+	WaitIntervalAttr: true,
+}
+
+// IsKnownAttr is true if mdrip does something with the given key.
+func IsKnownAttr(key string) bool { return knownAttrs[key] }
+
+// Add appends a value to those of the given key.
+func (a Attributes) Add(key, value string) {
+	a[key] = append(a[key], value)
+}
+
+// Has is true if the key was given at all.
+func (a Attributes) Has(key string) bool {
+	_, ok := a[key]
+	return ok
+}
+
+// Get returns the last value given to the key, as later values
+// override earlier ones.
+func (a Attributes) Get(key string) (string, bool) {
+	v := a[key]
+	if len(v) == 0 {
+		return "", false
+	}
+	return v[len(v)-1], true
+}
+
+// All returns every value given to the key, in order.
+func (a Attributes) All(key string) []string { return a[key] }
+
+// Duration returns the value of the key as a positive duration, and
+// whether the key was given.  It's an error if its value isn't one.
+func (a Attributes) Duration(key string) (time.Duration, bool, error) {
+	v, ok := a.Get(key)
+	if !ok {
+		return 0, false, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, true, fmt.Errorf("%s=%q is not a positive duration", key, v)
+	}
+	return d, true, nil
+}
+
+// Keys returns the keys given, sorted.
+func (a Attributes) Keys() []string {
+	keys := make([]string, 0, len(a))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -43,8 +43,42 @@ const (
 	WildCardLabel = Label(`__wildcard__`)
 	AnonLabel     = Label(`__anonymous__`)
 	SleepLabel    = Label(`sleep`)
+	// FailsLabel marks a block expected to exit with non-zero status.
+	FailsLabel = Label(`fails`)
+	// ExitLabel, as in @exit=2, marks a block expected to exit with
+	// the given status.
+	ExitLabel = Label(`exit`)
+	// CleanupLabel marks a block to run after the other blocks of its
+	// lesson, even if one of them failed.
+	CleanupLabel = Label(`cleanup`)
+	// TimeoutLabel, as in @timeout=5m, overrides the time a block is
+	// allowed to run.
+	TimeoutLabel = Label(`timeout`)
+	// ExpectLabel marks a fenced block as the expected output of
+	// the preceding command block.
+	ExpectLabel = Label(`expect`)
+	// SetupLabel marks a block that sets up the environment for
+	// those after it, e.g. by exporting variables, so that it runs
+	// even if the run starts at a later block.
+	SetupLabel = Label(`setup`)
 )
 
+// directives are the labels that say how to treat a block, rather
+// than naming it or selecting it.
+var directives = map[Label]bool{
+	SleepLabel:   true,
+	FailsLabel:   true,
+	ExitLabel:    true,
+	CleanupLabel: true,
+	TimeoutLabel: true,
+	ExpectLabel:  true,
+	SetupLabel:   true,
+}
+
+// IsDirective is true if the label says how to treat a block, e.g.
+// @sleep or @timeout, rather than naming it or selecting it.
+func (l Label) IsDirective() bool { return directives[l] }
+
 // OpaqueCode is an opaque, uninterpreted, unknown block of text that
 // is presumably shell commands parsed from markdown.  Fed into a
 // shell interpreter, the entire thing either succeeds or fails.
@@ -1,7 +1,9 @@
 package base
 
 import (
+	"strings"
 	"testing"
+	"time"
 )
 
 type btest struct {
@@ -25,3 +27,148 @@ func TestBase(t *testing.T) {
 		}
 	}
 }
+
+func TestMatchEllipsis(t *testing.T) {
+	tests := []struct {
+		expected string
+		actual   string
+		ok       bool
+	}{
+		{"kale\n", "kale\n\n", true},
+		{"kale\n", "kales\n", false},
+		{"id: ...\n", "id: 4f2a\n", true},
+		{"id: ...\n", "id: 4f2a\nmore\n", false},
+		{"a ... c\n", "a b c\n", true},
+		{"first\n...\nlast\n", "first\nlast\n", true},
+		{"first\n...\nlast\n", "first\none\ntwo\nlast", true},
+		{"first\n...\nlast\n", "first\none\ntwo\n", false},
+		{"price: $3.50 (...)\n", "price: $3.50 (today)\n", true},
+		{"price: $3.50\n", "price: $3050\n", false},
+		{"", "", true},
+	}
+	for _, test := range tests {
+		err := NewExpectedOutput(MatchEllipsis, test.expected).Match(test.actual)
+		if (err == nil) != test.ok {
+			t.Errorf("%q vs %q: got %v, want ok=%v", test.expected, test.actual, err, test.ok)
+		}
+	}
+}
+
+func TestLineIndex(t *testing.T) {
+	x := NewLineIndex("ab\n\nçd\nlast")
+	tests := []struct {
+		offset int
+		line   int
+		column int
+	}{
+		{0, 1, 1}, {2, 1, 3}, {3, 2, 1}, {4, 3, 1}, {7, 3, 3}, {8, 4, 1}, {99, 4, 5},
+	}
+	for _, test := range tests {
+		l := x.Location(test.offset)
+		if l.Line != test.line || l.Column != test.column {
+			t.Errorf("offset %d: got %d:%d, want %d:%d",
+				test.offset, l.Line, l.Column, test.line, test.column)
+		}
+	}
+	if got := x.Location(4).InFile("a.md").String(); got != "a.md:3" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestSelector(t *testing.T) {
+	labels := []Label{"lesson1", "linux", "install"}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"", true},
+		{"__wildcard__", true},
+		{"lesson1", true},
+		{"lesson2", false},
+		{"setup|lesson1", true},
+		{"setup | lesson2", false},
+		{"lesson1,!slow", true},
+		{"lesson1,!linux", false},
+		{"!lesson2", true},
+		{"!!lesson1", true},
+		{"(linux & install) | common", true},
+		{"(linux & windows) | common", false},
+		{"linux & (windows | install)", true},
+		{"setup | linux & !install", false},
+		{"lesson1 & linux, install", true},
+	}
+	for _, test := range tests {
+		s, err := ParseSelector(test.expr)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", test.expr, err)
+			continue
+		}
+		if got := s.Matches(labels); got != test.want {
+			t.Errorf("%q (%s): got %v, want %v", test.expr, s, got, test.want)
+		}
+	}
+	for _, bad := range []string{"a|", "(a", "a)", "a b", "&a", "a|!", "a-b", "@a"} {
+		if _, err := ParseSelector(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+	if !SelectorFor("a-b").Matches([]Label{"a-b"}) {
+		t.Errorf("expected an unparsable label to select itself")
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	a := Attributes{}
+	a.Add("env", "A=1")
+	a.Add("env", "B=2")
+	a.Add("timeout", "30s")
+	a.Add("wait", "soon")
+	if v, ok := a.Get("env"); !ok || v != "B=2" {
+		t.Errorf("got %q %v, want the last value", v, ok)
+	}
+	if v := a.All("env"); len(v) != 2 || v[0] != "A=1" {
+		t.Errorf("got %q, want every value", v)
+	}
+	if _, ok := a.Get("dir"); ok || a.Has("dir") {
+		t.Errorf("got a value for a missing key")
+	}
+	if d, ok, err := a.Duration("timeout"); !ok || err != nil || d != 30*time.Second {
+		t.Errorf("got %v %v %v, want 30s", d, ok, err)
+	}
+	if _, ok, err := a.Duration("wait"); !ok || err == nil {
+		t.Errorf("got no error for a bad duration")
+	}
+	if _, ok, err := a.Duration("dir"); ok || err != nil {
+		t.Errorf("got %v %v for a missing duration", ok, err)
+	}
+	if k := a.Keys(); strings.Join(k, ",") != "env,timeout,wait" {
+		t.Errorf("got keys %v", k)
+	}
+	var none Attributes
+	if _, ok := none.Get("env"); ok {
+		t.Errorf("got a value from nil attributes")
+	}
+}
+
+func TestFenceClosedBy(t *testing.T) {
+	tests := []struct {
+		fence Fence
+		line  string
+		want  bool
+	}{
+		{Fence{'`', 3}, "```", true},
+		{Fence{'`', 3}, "   ````  ", true},
+		{Fence{'`', 3}, "    ```", false},
+		{Fence{'`', 3}, "``` go", false},
+		{Fence{'`', 3}, "~~~", false},
+		{Fence{'`', 4}, "```", false},
+		{Fence{'~', 3}, "~~~~\r", true},
+		{Fence{'~', 3}, "~~", false},
+		{Fence{}, "", false},
+	}
+	for _, test := range tests {
+		if got := test.fence.ClosedBy(test.line); got != test.want {
+			t.Errorf("%s closed by %q: got %v, want %v", test.fence, test.line, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package base
+
+import "fmt"
+
+// DiagnosticKind classifies a problem found in a markdown file.
+type DiagnosticKind string
+
+const (
+	UnclosedComment   = DiagnosticKind(`unclosed-comment`)
+	UnclosedLabels    = DiagnosticKind(`unclosed-labels`)
+	EmptyLabel        = DiagnosticKind(`empty-label`)
+	EmptyLabelValue   = DiagnosticKind(`empty-label-value`)
+	BadLabelsClose    = DiagnosticKind(`bad-labels-close`)
+	LabelsWithoutCode = DiagnosticKind(`labels-without-code`)
+	UnclosedBlock     = DiagnosticKind(`unclosed-block`)
+	BadAttribute      = DiagnosticKind(`bad-attribute`)
+	DetachedOutput    = DiagnosticKind(`detached-output`)
+	// The rest are found by linting, rather than parsing.
+	UnlabelledBlock = DiagnosticKind(`unlabelled-block`)
+	LoneLabel       = DiagnosticKind(`lone-label`)
+	TrailingSpace   = DiagnosticKind(`trailing-space`)
+	CarriageReturn  = DiagnosticKind(`carriage-return`)
+	ShellSyntax     = DiagnosticKind(`shell-syntax`)
+	UnknownAttr     = DiagnosticKind(`unknown-attribute`)
+)
+
+// Diagnostic describes a problem found in a markdown file, and where.
+type Diagnostic struct {
+	Kind     DiagnosticKind
+	Location Location
+	Snippet  string // The text at Location.
+	Message  string
+}
+
+// String returns e.g. `a.md:3:5: unclosed comment: "<!-- oops"`.
+func (d Diagnostic) String() string {
+	where := fmt.Sprintf("%s:%d:%d", d.Location.File, d.Location.Line, d.Location.Column)
+	if d.Location.File == "" {
+		where = fmt.Sprintf("line %d, column %d", d.Location.Line, d.Location.Column)
+	}
+	if d.Snippet == "" {
+		return fmt.Sprintf("%s: %s", where, d.Message)
+	}
+	return fmt.Sprintf("%s: %s: %q", where, d.Message, d.Snippet)
+}
@@ -0,0 +1,190 @@
+package base
+
+import (
+	"regexp"
+	"strings"
+)
+
+// MatchMode says how ExpectedOutput is compared to actual output.
+type MatchMode int
+
+const (
+	// MatchExact wants actual output identical to the expected
+	// output, ignoring trailing newlines.
+	MatchExact MatchMode = iota
+	// MatchRegexp wants the expected output, treated as a regular
+	// expression, to match somewhere in the actual output.
+	MatchRegexp
+	// MatchContains wants the expected output to appear somewhere
+	// in the actual output.
+	MatchContains
+	// MatchEllipsis wants actual output identical to the expected
+	// output, except that a line holding just "..." stands for any
+	// number of lines, and "..." within a line for any text on that
+	// line.
+	MatchEllipsis
+)
+
+func (m MatchMode) String() string {
+	switch m {
+	case MatchExact:
+		return "exact"
+	case MatchRegexp:
+		return "regexp"
+	case MatchContains:
+		return "contains"
+	case MatchEllipsis:
+		return "ellipsis"
+	default:
+		return "unknown"
+	}
+}
+
+// MatchModeFromString converts a mode name back to a MatchMode.
+func MatchModeFromString(s string) (MatchMode, bool) {
+	for _, m := range []MatchMode{MatchExact, MatchRegexp, MatchContains, MatchEllipsis} {
+		if m.String() == s {
+			return m, true
+		}
+	}
+	return MatchExact, false
+}
+
+// Span is a half-open range of byte offsets into a source file.
+type Span struct {
+	Start int
+	End   int
+}
+
+// A Fence is the run of backticks or tildes opening a fenced block.
+type Fence struct {
+	Char   byte // '`' or '~'.
+	Length int
+}
+
+// MaxFenceIndent is how far, per CommonMark, a fence may be indented.
+const MaxFenceIndent = 3
+
+// ClosedBy is true if the line closes a block opened by the fence.
+// Per CommonMark, it does if it holds a run of at least as many of
+// the same character, indented by at most three spaces, followed by
+// nothing but white space.  The line's indentation is counted from
+// that of the opening fence.
+func (f Fence) ClosedBy(line string) bool {
+	if f.Length == 0 {
+		return false
+	}
+	i := 0
+	for i < len(line) && line[i] == ' ' {
+		i++
+	}
+	if i > MaxFenceIndent {
+		return false
+	}
+	n := 0
+	for i+n < len(line) && line[i+n] == f.Char {
+		n++
+	}
+	return n >= f.Length && strings.TrimSpace(line[i+n:]) == ""
+}
+
+func (f Fence) String() string { return strings.Repeat(string(f.Char), f.Length) }
+
+// ExpectedOutput is what a command block should write to stdout.
+type ExpectedOutput struct {
+	mode   MatchMode
+	text   string
+	span   Span  // Where text was found, if known.
+	indent int   // How far text is indented there.
+	fence  Fence // The fence enclosing text there.
+}
+
+func NewExpectedOutput(m MatchMode, text string) *ExpectedOutput {
+	return &ExpectedOutput{m, text, Span{-1, -1}, 0, Fence{}}
+}
+
+func (x *ExpectedOutput) Mode() MatchMode { return x.mode }
+func (x *ExpectedOutput) Text() string    { return x.text }
+func (x *ExpectedOutput) Span() Span      { return x.span }
+func (x *ExpectedOutput) Indent() int     { return x.indent }
+func (x *ExpectedOutput) Fence() Fence    { return x.fence }
+
+func (x *ExpectedOutput) SetSpan(s Span) *ExpectedOutput {
+	x.span = s
+	return x
+}
+
+// SetIndent records that each line of text is indented by n spaces
+// in the source, e.g. because it's in a list item.
+func (x *ExpectedOutput) SetIndent(n int) *ExpectedOutput {
+	x.indent = n
+	return x
+}
+
+// SetFence records the fence enclosing text in the source.
+func (x *ExpectedOutput) SetFence(f Fence) *ExpectedOutput {
+	x.fence = f
+	return x
+}
+
+// Match returns nil if the actual output meets expectations, else
+// an error describing the mismatch.
+func (x *ExpectedOutput) Match(actual string) error {
+	switch x.mode {
+	case MatchRegexp:
+		re, err := regexp.Compile(strings.TrimRight(x.text, "\n"))
+		if err != nil {
+			return err
+		}
+		if !re.MatchString(actual) {
+			return errMismatch
+		}
+	case MatchContains:
+		if !strings.Contains(actual, strings.TrimRight(x.text, "\n")) {
+			return errMismatch
+		}
+	case MatchEllipsis:
+		re := regexp.MustCompile(ellipsisPattern(x.text))
+		if !re.MatchString(strings.TrimRight(actual, "\n") + "\n") {
+			return errMismatch
+		}
+	default:
+		if strings.TrimRight(actual, "\n") != strings.TrimRight(x.text, "\n") {
+			return errMismatch
+		}
+	}
+	return nil
+}
+
+// ellipsis stands for text that varies from run to run.
+const ellipsis = "..."
+
+// ellipsisPattern converts expected output holding ellipses into a
+// regular expression matching the whole of some output, where the
+// output ends with exactly one newline.
+func ellipsisPattern(text string) string {
+	var b strings.Builder
+	b.WriteString(`\A`)
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		if strings.TrimSpace(line) == ellipsis {
+			b.WriteString(`(?:[^\n]*\n)*`)
+			continue
+		}
+		parts := strings.Split(line, ellipsis)
+		for i, p := range parts {
+			if i > 0 {
+				b.WriteString(`[^\n]*`)
+			}
+			b.WriteString(regexp.QuoteMeta(p))
+		}
+		b.WriteString(`\n`)
+	}
+	b.WriteString(`\z`)
+	return b.String()
+}
+
+type mismatchError struct{}
+
+func (mismatchError) Error() string { return "output did not match expectations" }
+
+var errMismatch = mismatchError{}
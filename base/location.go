@@ -0,0 +1,74 @@
+package base
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Location is where something is in a markdown file.  Lines and
+// columns count from 1; a Line of 0 means the location isn't known.
+type Location struct {
+	File    FilePath
+	Line    int
+	Column  int
+	EndLine int // The last line, if the thing spans several.
+}
+
+func (l Location) Known() bool { return l.Line > 0 }
+
+// String returns e.g. "tutorial.md:42", a form editors can jump to.
+func (l Location) String() string {
+	switch {
+	case !l.Known():
+		return string(l.File)
+	case l.File == "":
+		return fmt.Sprintf("line %d", l.Line)
+	}
+	return fmt.Sprintf("%s:%d", l.File, l.Line)
+}
+
+// InFile returns the location in the given file.
+func (l Location) InFile(f FilePath) Location {
+	l.File = f
+	return l
+}
+
+// LineIndex converts byte offsets into a text to lines and columns.
+type LineIndex struct {
+	text   string
+	starts []int // Offset of each line's first byte.
+}
+
+func NewLineIndex(text string) *LineIndex {
+	starts := []int{0}
+	for i := strings.IndexByte(text, '\n'); i >= 0; {
+		starts = append(starts, starts[len(starts)-1]+i+1)
+		i = strings.IndexByte(text[starts[len(starts)-1]:], '\n')
+	}
+	return &LineIndex{text, starts}
+}
+
+// Location returns the line, and the column counted in characters,
+// of the given offset.
+func (x *LineIndex) Location(offset int) Location {
+	if offset > len(x.text) {
+		offset = len(x.text)
+	}
+	line := sort.SearchInts(x.starts, offset+1) - 1
+	col := utf8.RuneCountInString(x.text[x.starts[line]:offset]) + 1
+	return Location{Line: line + 1, Column: col}
+}
+
+// Line returns the text of the given line, without its line ending.
+func (x *LineIndex) Line(n int) string {
+	if n < 1 || n > len(x.starts) {
+		return ""
+	}
+	end := len(x.text)
+	if n < len(x.starts) {
+		end = x.starts[n]
+	}
+	return strings.TrimRight(x.text[x.starts[n-1]:end], "\r\n")
+}
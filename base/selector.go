@@ -0,0 +1,202 @@
+package base
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A Selector picks blocks by their labels.  It's parsed from a
+// boolean expression over labels, e.g.
+//
+//	lesson1                   blocks labelled @lesson1
+//	setup|lesson1             blocks labelled @setup or @lesson1
+//	lesson1,!slow             blocks labelled @lesson1 but not @slow
+//	(linux & install) | common
+//
+// Both "," and "&" mean and.  "!" binds tightest, then and, then or.
+type Selector interface {
+	// Matches is true if a block with the given labels is selected.
+	Matches(labels []Label) bool
+	String() string
+}
+
+// ParseSelector parses a label expression.  The wildcard label, or
+// an empty expression, selects every block.
+func ParseSelector(s string) (Selector, error) {
+	if strings.TrimSpace(s) == "" || Label(s) == WildCardLabel {
+		return selectAll{}, nil
+	}
+	p := &selectorParser{input: s}
+	x, err := p.parseOr()
+	if err == nil && p.peek() != 0 {
+		err = p.errorf("unexpected %q", p.peek())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// SelectorFor returns the selector for the expression held by a label,
+// e.g. by the argument of --label.  An expression that doesn't parse
+// selects blocks with exactly that label.
+func SelectorFor(l Label) Selector {
+	s, err := ParseSelector(string(l))
+	if err != nil {
+		return selectLabel(l)
+	}
+	return s
+}
+
+type selectAll struct{}
+
+func (selectAll) Matches([]Label) bool { return true }
+func (selectAll) String() string       { return string(WildCardLabel) }
+
+type selectLabel Label
+
+func (x selectLabel) Matches(labels []Label) bool {
+	for _, l := range labels {
+		if l == Label(x) {
+			return true
+		}
+	}
+	return false
+}
+func (x selectLabel) String() string { return string(x) }
+
+type selectNot struct{ x Selector }
+
+func (n selectNot) Matches(labels []Label) bool { return !n.x.Matches(labels) }
+func (n selectNot) String() string              { return "!" + n.x.String() }
+
+type selectAnd []Selector
+
+func (a selectAnd) Matches(labels []Label) bool {
+	for _, x := range a {
+		if !x.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+func (a selectAnd) String() string { return joinSelectors(a, " & ") }
+
+type selectOr []Selector
+
+func (o selectOr) Matches(labels []Label) bool {
+	for _, x := range o {
+		if x.Matches(labels) {
+			return true
+		}
+	}
+	return false
+}
+func (o selectOr) String() string { return joinSelectors(o, " | ") }
+
+func joinSelectors(xs []Selector, op string) string {
+	parts := make([]string, len(xs))
+	for i, x := range xs {
+		parts[i] = x.String()
+	}
+	return "(" + strings.Join(parts, op) + ")"
+}
+
+// selectorParser is a recursive descent parser for label expressions.
+type selectorParser struct {
+	input string
+	pos   int
+}
+
+func (p *selectorParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("label expression %q, at %d: %s",
+		p.input, p.pos+1, fmt.Sprintf(format, args...))
+}
+
+// peek returns the next non-blank byte, or 0 at the end.
+func (p *selectorParser) peek() byte {
+	for p.pos < len(p.input) && (p.input[p.pos] == ' ' || p.input[p.pos] == '\t') {
+		p.pos++
+	}
+	if p.pos == len(p.input) {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+func (p *selectorParser) parseOr() (Selector, error) {
+	var result selectOr
+	for {
+		x, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, x)
+		if p.peek() != '|' {
+			break
+		}
+		p.pos++
+	}
+	if len(result) == 1 {
+		return result[0], nil
+	}
+	return result, nil
+}
+
+func (p *selectorParser) parseAnd() (Selector, error) {
+	var result selectAnd
+	for {
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, x)
+		if c := p.peek(); c != '&' && c != ',' {
+			break
+		}
+		p.pos++
+	}
+	if len(result) == 1 {
+		return result[0], nil
+	}
+	return result, nil
+}
+
+func (p *selectorParser) parseNot() (Selector, error) {
+	switch c := p.peek(); {
+	case c == '!':
+		p.pos++
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return selectNot{x}, nil
+	case c == '(':
+		p.pos++
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, p.errorf("missing )")
+		}
+		p.pos++
+		return x, nil
+	case isLabelChar(c):
+		start := p.pos
+		for p.pos < len(p.input) && isLabelChar(p.input[p.pos]) {
+			p.pos++
+		}
+		return selectLabel(p.input[start:p.pos]), nil
+	case c == 0:
+		return nil, p.errorf("expected a label")
+	default:
+		return nil, p.errorf("unexpected %q", c)
+	}
+}
+
+// isLabelChar is true for the bytes that can make up a label name.
+func isLabelChar(c byte) bool {
+	return c == '_' || ('0' <= c && c <= '9') ||
+		('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
@@ -8,11 +8,13 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 	"unicode"
 
 	"github.com/golang/glog"
 	"github.com/monopole/mdrip/base"
+	"github.com/monopole/mdrip/util"
 )
 
 const (
@@ -58,6 +60,47 @@ while the command 'mdrip --label platitude {fileName}' emits:
 
   echo "an apple a day keeps the doctor away"
 
+The label may be an expression, combining labels with '|' (or), '&'
+or ',' (and), '!' (not) and parentheses, e.g.
+
+  mdrip --label 'foo|apple' {fileName}
+  mdrip --label 'foo,!bar' {fileName}
+  mdrip --label '(linux & install) | common' {fileName}
+
+'!' binds tightest, then and, then or.
+
+Rather than select blocks by label, one can ask for a block by name
+(its first label), along with the blocks it needs, e.g.
+
+  mdrip --mode test --target makeMain {fileName}
+
+A block names the blocks it needs in its label comment, e.g.
+
+  <!-- @makeMain needs=init,makeAdder -->
+
+Those blocks may need others in turn, and so on; --target selects
+them all, keeping them in their usual order.  A block may only need
+blocks that come before it, and mdrip refuses to run if a needed
+name is that of no block, or if blocks need each other in a cycle.
+--target takes a comma separated list of names, and can't be given
+with --label.
+
+To start or stop somewhere in the middle, e.g. to resume a test run
+from the block that failed, use --from and --to, in test or print
+mode:
+
+  mdrip --mode test --from tutorial:37 {fileName}
+  mdrip --from tutorial:makeAdder --to tutorial:makeMain {fileName}
+
+Each names a block as {lesson}:{block}, or just {block}, where the
+lesson is a file's name without extension, its path, or its number,
+and the block is a block's name or its number in the file, counting
+from 1 as in test reports.  Without a lesson, the first block that
+matches in any file is meant.  Blocks before --from that are
+labelled @setup, e.g. those exporting variables that later blocks
+use, still run first.  When a test run fails, its report ends with
+the command that resumes it from the failed block.
+
 
 Modes:
 
@@ -115,32 +158,216 @@ Modes:
    This runs extracted blocks in an mdrip subshell, leaving the
    executing shell unchanged.
 
-   In this mode, mdrip captures the stdout and stderr of the
-   subprocess, reporting only blocks that fail, facilitating error
-   diagnosis.
+   In this mode, mdrip captures the stdout and stderr of each block,
+   reporting to stderr the status (passed, failed, timed out or
+   skipped) of every block, followed by the code and captured output
+   of any block that failed, facilitating error diagnosis.
 
    Normally, mdrip exits with non-zero status only when used
    incorrectly, e.g. file not found, bad flags, etc.  In in test mode,
    mdrip will exit with the status of any failing code block.
+
+   A block labelled @fails passes only if it exits with non-zero
+   status, and one labelled e.g. @exit=2 only if it exits with status
+   2.  Such blocks run in a subshell, so later blocks still run, but
+   any environment changes they make are lost.
+
+   A block gets --blockTimeOut to finish, unless it's labelled with
+   its own limit, e.g. @timeout=5m or timeout=5m.  The limit is on
+   the time the block takes to exit, however much it writes
+   meanwhile.  Use --runTimeOut to limit the time taken by all blocks
+   together; when it runs out, the running block is killed and the
+   rest skipped, but cleanup blocks still run.
+
+   All blocks from all files normally run in one shell, so the first
+   failure skips everything after it.  With --keepGoing, each file
+   runs in its own shell; a failure skips only the rest of its own
+   file, and mdrip exits with non-zero status if any file failed.
+
+   With --parallel {n}, up to n files run at once, each in its own
+   shell with a fresh temporary working directory.  The report still
+   lists files in their usual order.  Unless --keepGoing is also
+   given, a failure stops files not yet started from running.
+
+   Label comments may also hold key=value attributes, quoted if
+   they hold spaces, e.g.
+
+     <!-- @server dir=/tmp/x env=FOO=bar skip-if="! command -v docker" -->
+
+   runs the block in /tmp/x with FOO set, in a subshell so that
+   neither carries over to later blocks, unless 'command -v docker'
+   fails, in which case the block is skipped.  Repeat env to set
+   more variables.
+
+   A block with session={name} runs in a shell of its own, kept for
+   the whole run, with its own variables and working directory, e.g.
+   for a server in one session and a client in another.  Blocks
+   still run one at a time, in order.  The report groups blocks by
+   session, and all sessions are killed at the end.
+
+   A block with wait-port=8080, wait-file={path} or wait-cmd={command}
+   waits, once its code has run, until something listens on the
+   port, the file exists or the command succeeds, checking every
+   wait-interval (default 500ms) for up to wait-timeout (default
+   30s) before failing.  Print mode writes these out as shell loops.
+   A port is checked with bash's /dev/tcp, or, in other shells, with
+   'nc -z'; in a shell with neither, the block fails at once.
+
+   With --env {NAME}={value}, blocks run with the variable set, as
+   they do with each variable set in an --envFile, one {NAME}={value}
+   per line.  With --cleanEnv, they see nothing else of the caller's
+   environment but the variables named by --keepEnv.  The report
+   lists what was set, so that the run can be repeated.
+
+   Blocks labelled @cleanup don't run in the usual order.  When a
+   shell ends, for whatever reason, the cleanup blocks of every file
+   it started run, each whether or not the one before it worked.
+   They see the variables, functions and working directory the shell
+   ended with, and are reported apart from the other blocks.
+
+   Each shell runs in its own process group.  A block that times out
+   is killed along with everything else in its group.  Processes left
+   running when a shell ends, e.g. servers started in the background,
+   are killed after the cleanup blocks run, and listed in the report
+   if the shell failed.  Ctrl-C kills every group; a second Ctrl-C
+   exits at once.
+
+   A block's language is the first word of its fence's info string.
+   Blocks with no language, or bash, shell, sh, zsh or console
+   (whose '$ ' lines are the commands), run in the shell itself.
+   Blocks in python or go are written to a file and run with that
+   tool, still seeing the shell's environment and working directory.
+   Blocks in any other language are skipped, with a note in the
+   report.  Print mode prints every block's code as it stands, less
+   a console block's prompts and output.
+
+   Use '--report {format}={path}' to additionally write the results
+   in a machine readable format, e.g.
+
+     mdrip --mode test --report junit=results.xml /path/to/tutorial.md
+
+   writes each file as a JUnit testsuite and each block as a testcase.
+   The formats 'tap' (TAP version 13) and 'json' (newline delimited
+   JSON events) are streamed as blocks run.  Omitting the path, or
+   using '-', means stdout.  The flag may be repeated.
+
+ --mode update
+
+   Use this flag to keep documented output current.
+
+   A fenced block with the info string 'output', placed right after
+   a command block, with nothing but blank lines between, holds the
+   output that the command block is expected to write to stdout.  In
+   --mode test, blocks producing anything else fail, with a diff.  Use 'output regexp' or 'output contains' to
+   match a pattern or a substring instead, or 'output ellipsis' to
+   let a line holding just '...' stand for any number of lines, and
+   '...' within a line for any text on that line.
+
+   A console block is a transcript: '$ ' prompts its commands, and
+   the lines after each command are what it should write to stdout,
+   compared as with 'output ellipsis' unless an 'output' fence
+   follows.  Printed blocks hold only the commands.
+
+   In --mode update, blocks run as in --mode test, and then the content
+   of each 'output' fence is replaced, in the markdown file itself, with
+   the output its block actually produced.  No other bytes in the file
+   change.  Fences holding patterns, and fences of blocks that failed
+   or didn't run, are left alone.
+
+ --mode lint
+
+   Use this flag to find problems in markdown without running it.
+
+   mdrip reports, one per line as 'file:line:column: message', label
+   comments that are malformed or not followed by a code fence,
+   unclosed comments and fences, unlabelled blocks in files whose
+   other blocks are labelled, labels used only once other than as a
+   block's name (likely typos), unknown attributes, trailing
+   whitespace and carriage returns in blocks, and blocks in which
+   'bash -n' finds syntax errors.  mdrip exits with non-zero status
+   if it finds anything.
 `
 )
 
 type ModeType int
 
+// ReportFormat names a machine readable test report format.
+type ReportFormat string
+
+const (
+	ReportJUnit = ReportFormat("junit")
+	ReportTap   = ReportFormat("tap")
+	ReportJson  = ReportFormat("json")
+)
+
+// Streaming reports are written while blocks run, rather than
+// once the run completes.
+func (f ReportFormat) Streaming() bool {
+	return f == ReportTap || f == ReportJson
+}
+
+// StdOutPath is a report path meaning stdout rather than a file.
+const StdOutPath = "-"
+
+// ReportSpec asks for a report in the given format at the given path.
+type ReportSpec struct {
+	Format ReportFormat
+	Path   string
+}
+
+// reportSpecs is a repeatable flag.Value holding ReportSpecs.
+type reportSpecs []ReportSpec
+
+func (r *reportSpecs) String() string {
+	result := []string{}
+	for _, s := range *r {
+		result = append(result, string(s.Format)+"="+s.Path)
+	}
+	return strings.Join(result, ",")
+}
+
+func (r *reportSpecs) Set(v string) error {
+	f, path := ReportFormat(v), StdOutPath
+	if i := strings.Index(v, "="); i > -1 {
+		f, path = ReportFormat(v[:i]), v[i+1:]
+	}
+	if len(path) == 0 {
+		return fmt.Errorf("report %q should look like {format}[={path}]", v)
+	}
+	switch f {
+	case ReportJUnit, ReportTap, ReportJson:
+	default:
+		return fmt.Errorf("unknown report format %q", f)
+	}
+	*r = append(*r, ReportSpec{f, path})
+	return nil
+}
+
 const (
 	ModeUnknown ModeType = iota
 	ModePrint
 	ModeTest
 	ModeWeb
 	ModeTmux
+	ModeUpdate
+	ModeLint
 )
 
 var (
 	mode = flag.String("mode", "print",
-		`Mode is print, test, web or tmux.`)
+		`Mode is print, test, update, lint, web or tmux.`)
 
 	label = flag.String("label", "",
-		`Using "--label foo" means extract only blocks annotated with "<!-- @foo -->".`)
+		`Using "--label foo" means extract only blocks annotated with "<!-- @foo -->".  Labels may be combined with | (or), & or , (and), ! (not) and parentheses, e.g. "--label 'lesson1,!slow'".`)
+
+	target = flag.String("target", "",
+		`Extract only the blocks with the given names (first labels), comma separated, and the blocks they need, as said by needs={names} in their label comments.`)
+
+	from = flag.String("from", "",
+		`Extract blocks starting at the given one, as {lesson}:{block} or {block}, by name or number, e.g. "tutorial:12".  Blocks labelled @setup before it are extracted too.`)
+
+	to = flag.String("to", "",
+		`Extract blocks up to and including the given one, as for --from.`)
 
 	preambled = flag.Int("preambled", 0,
 		`In --mode print, run the first {n} blocks in the current shell, and the rest in a trapped subshell.`)
@@ -152,12 +379,63 @@ var (
 		`In --mode web, expose HTTP at the given port.`)
 
 	blockTimeOut = flag.Duration("blockTimeOut", 7*time.Second,
-		`In --mode test, the max amount of time to wait for a command block to exit.`)
+		`In --mode test, the max amount of time to wait for a command block to exit, unless the block says otherwise with @timeout={duration}.`)
+
+	runTimeOut = flag.Duration("runTimeOut", 0,
+		`In --mode test, the max amount of time to wait for all command blocks to exit, not counting cleanup blocks.  Zero means no limit.`)
 
 	ignoreTestFailure = flag.Bool("ignoreTestFailure", false,
 		`In --mode test, exit with success regardless of extracted code failure.`)
+
+	keepGoing = flag.Bool("keepGoing", false,
+		`In --mode test, run each file in its own shell, so a failure in one file doesn't stop the others.`)
+
+	parallel = flag.Int("parallel", 1,
+		`In --mode test, run up to {n} files at once, each in its own shell and temporary directory.`)
+
+	cleanEnv = flag.Bool("cleanEnv", false,
+		`In --mode test or update, run blocks in an environment holding only the variables named by --keepEnv, plus those set by --env and --envFile.`)
+
+	keepEnv = flag.String("keepEnv", "HOME,LANG,PATH,TERM,TMPDIR,USER",
+		`With --cleanEnv, the variables, comma separated, to keep from mdrip's own environment.`)
+
+	reports  reportSpecs
+	envVars  envSettings
+	envFiles stringList
 )
 
+func init() {
+	flag.Var(&reports, "report",
+		`In --mode test, also write results as {format}[={path}], where format is junit, tap or json.  Repeatable.`)
+	flag.Var(&envVars, "env",
+		`In --mode test or update, set {NAME}={value} in the environment blocks run in, overriding --envFile.  Repeatable.`)
+	flag.Var(&envFiles, "envFile",
+		`In --mode test or update, set the variables in the given file, one {NAME}={value} per line, in the environment blocks run in.  Repeatable.`)
+}
+
+// envSettings is a repeatable flag.Value holding NAME=value settings.
+type envSettings []string
+
+func (e *envSettings) String() string { return strings.Join(*e, ",") }
+
+func (e *envSettings) Set(v string) error {
+	if _, _, ok := util.SplitEnv(v); !ok {
+		return fmt.Errorf("env %q should look like {NAME}={value}", v)
+	}
+	*e = append(*e, v)
+	return nil
+}
+
+// stringList is a repeatable flag.Value holding strings.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
 type Config struct {
 	label      base.Label
 	mode       ModeType
@@ -181,6 +459,10 @@ func determineMode() ModeType {
 		return ModeWeb
 	case 'u': // tmux
 		return ModeTmux
+	case 'd': // update
+		return ModeUpdate
+	case 'n': // lint
+		return ModeLint
 	default:
 		return ModePrint
 	}
@@ -197,6 +479,31 @@ func (c *Config) BlockTimeOut() time.Duration {
 	return *blockTimeOut
 }
 
+func (c *Config) RunTimeOut() time.Duration {
+	return *runTimeOut
+}
+
+// Target returns the names given with --target, if any.
+func (c *Config) Target() []string {
+	result := []string{}
+	for _, n := range strings.Split(*target, ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			result = append(result, n)
+		}
+	}
+	return result
+}
+
+// From returns the block given with --from, if any.
+func (c *Config) From() string {
+	return *from
+}
+
+// To returns the block given with --to, if any.
+func (c *Config) To() string {
+	return *to
+}
+
 func (c *Config) Preambled() int {
 	return *preambled
 }
@@ -221,6 +528,43 @@ func (c *Config) IgnoreTestFailure() bool {
 	return *ignoreTestFailure
 }
 
+func (c *Config) KeepGoing() bool {
+	return *keepGoing
+}
+
+func (c *Config) Parallel() int {
+	return *parallel
+}
+
+func (c *Config) Reports() []ReportSpec {
+	return reports
+}
+
+// Env returns the settings given with --env, in order.
+func (c *Config) Env() []string {
+	return envVars
+}
+
+// EnvFiles returns the files given with --envFile, in order.
+func (c *Config) EnvFiles() []string {
+	return envFiles
+}
+
+func (c *Config) CleanEnv() bool {
+	return *cleanEnv
+}
+
+// KeepEnv returns the variables named by --keepEnv.
+func (c *Config) KeepEnv() []string {
+	result := []string{}
+	for _, n := range strings.Split(*keepEnv, ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			result = append(result, n)
+		}
+	}
+	return result
+}
+
 func (c *Config) Label() base.Label {
 	return c.label
 }
@@ -242,16 +586,63 @@ func GetConfig() (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	if _, err := base.ParseSelector(*label); err != nil {
+		return nil, errors.New(`Bad --label: ` + err.Error())
+	}
 	desiredMode := determineMode()
 	if desiredMode == ModeUnknown {
-		return nil, errors.New(`For mode, specify print, test, web or tmux.`)
+		return nil, errors.New(`For mode, specify print, test, update, lint, web or tmux.`)
+	}
+	if len(*target) > 0 && len(*label) > 0 {
+		return nil, errors.New(`Specify --label or --target, not both.`)
+	}
+	if len(*target) > 0 && (desiredMode == ModeWeb || desiredMode == ModeTmux || desiredMode == ModeLint) {
+		return nil, errors.New(`Makes no sense to specify --target with --mode web, tmux or lint.`)
+	}
+	if len(*from)+len(*to) > 0 && desiredMode != ModeTest && desiredMode != ModePrint {
+		return nil, errors.New(`Makes no sense to specify --from or --to without --mode test or print.`)
 	}
 	if *ignoreTestFailure && desiredMode != ModeTest {
 		return nil, errors.New(`Makes no sense to specify --ignoreTestFailure without --mode test.`)
 	}
+	if *keepGoing && desiredMode != ModeTest {
+		return nil, errors.New(`Makes no sense to specify --keepGoing without --mode test.`)
+	}
+	if *parallel < 1 {
+		return nil, errors.New(`The value of --parallel must be at least 1.`)
+	}
+	if *parallel > 1 && desiredMode != ModeTest {
+		return nil, errors.New(`Makes no sense to specify --parallel without --mode test.`)
+	}
+	if *runTimeOut < 0 {
+		return nil, errors.New(`The value of --runTimeOut must not be negative.`)
+	}
+	if *runTimeOut > 0 && desiredMode != ModeTest && desiredMode != ModeUpdate {
+		return nil, errors.New(`Makes no sense to specify --runTimeOut without --mode test or update.`)
+	}
+	if len(reports) > 0 && desiredMode != ModeTest {
+		return nil, errors.New(`Makes no sense to specify --report without --mode test.`)
+	}
+	if (len(envVars)+len(envFiles) > 0 || *cleanEnv) && desiredMode != ModeTest && desiredMode != ModeUpdate {
+		return nil, errors.New(`Makes no sense to specify --env, --envFile or --cleanEnv without --mode test or update.`)
+	}
+	if isFlagSet("keepEnv") && !*cleanEnv {
+		return nil, errors.New(`Makes no sense to specify --keepEnv without --cleanEnv.`)
+	}
 	return &Config{determineLabel(), desiredMode, dataSource}, nil
 }
 
+// isFlagSet is true if the named flag was given on the command line.
+func isFlagSet(name string) bool {
+	result := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			result = true
+		}
+	})
+	return result
+}
+
 func Usage() {
 	fmt.Fprintf(os.Stderr, "\nUsage:  %s {fileName}...\n", os.Args[0])
 	fmt.Fprint(os.Stderr, usageText)
@@ -7,11 +7,13 @@ package lexer
 
 import (
 	"fmt"
+	"regexp"
 	"strings"
 	"unicode/utf8"
 
 	"github.com/monopole/mdrip/base"
 	"github.com/monopole/mdrip/model"
+	"github.com/monopole/mdrip/util"
 )
 
 type position int
@@ -22,6 +24,10 @@ const (
 	itemError      itemType = iota
 	itemProse               // Prose between command blocks.
 	itemBlockLabel          // Label for a command block
+	itemLabelValue          // Value following "=" in a label, e.g. 2 in @exit=2
+	itemAttrKey             // Key of an attribute, e.g. dir in dir=/tmp
+	itemAttrValue           // Value of an attribute, unquoted, e.g. /tmp
+	itemCodeInfo            // Info string following an opening codeFence
 	itemCodeBlock           // All lines between codeFence marks
 	itemEOF
 )
@@ -34,6 +40,14 @@ func textType(t itemType) string {
 		return "PROSE"
 	case itemBlockLabel:
 		return "LABEL"
+	case itemLabelValue:
+		return "VALUE"
+	case itemAttrKey:
+		return "KEY"
+	case itemAttrValue:
+		return "ATTR"
+	case itemCodeInfo:
+		return "INFO"
 	case itemCodeBlock:
 		return "BLOCK"
 	case itemEOF:
@@ -44,8 +58,13 @@ func textType(t itemType) string {
 }
 
 type item struct {
-	typ itemType // Type of this item.
-	val string   // The value of this item.
+	typ    itemType            // Type of this item.
+	val    string              // The value of this item.
+	pos    position            // Offset of the value in the input.
+	indent int                 // For a code block, the indentation of its fence.
+	fence  base.Fence          // For a code block, its fence.
+	open   position            // For a code block, the offset of its fence.
+	kind   base.DiagnosticKind // For an error, what went wrong.
 }
 
 func (i item) String() string {
@@ -66,12 +85,15 @@ func (i item) String() string {
 
 const (
 	labelMarker  = '@'
+	labelValueOp = '='
 	commentOpen  = "<!--"
 	commentClose = "-->"
 	codeFence    = "```"
 	// All punctuation except for < (comment start) and ` (code block start),
-	mdPunct           = "!->@#$%^&*()_=+\\|~{}[];:'\",.?/ \r\n\t"
-	lettersAndNumbers = "012345789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	lettersAndNumbers = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	labelValueChars   = "_.:/+" + lettersAndNumbers
+	attrKeyChars      = "_-" + lettersAndNumbers
+	attrQuote         = '"'
 )
 
 const eof = -1
@@ -79,12 +101,15 @@ const eof = -1
 type stateFn func(*lexer) stateFn
 
 type lexer struct {
-	input   string    // string being scanned
-	state   stateFn   // the next lexing function to enter
-	current position  // current position in 'input'
-	start   position  // start of this item
-	width   position  // width of last rune read
-	items   chan item // channel of scanned items
+	input      string    // string being scanned
+	state      stateFn   // the next lexing function to enter
+	current    position  // current position in 'input'
+	start      position  // start of this item
+	width      position  // width of last rune read
+	items      chan item // channel of scanned items
+	fence      fence     // opening fence of the current code block
+	listIndent int       // indentation of the current list item's content
+	comment    position  // start of the current comment
 }
 
 // next returns the next rune in the input.
@@ -110,7 +135,7 @@ func (l *lexer) backup() {
 }
 
 func (l *lexer) emit(t itemType) {
-	l.items <- item{t, l.input[l.start:l.current]}
+	l.items <- item{typ: t, val: l.input[l.start:l.current], pos: l.start}
 	l.start = l.current
 }
 
@@ -136,11 +161,25 @@ func (l *lexer) acceptRun(valid string) {
 	l.backup()
 }
 
-// errorf returns an error token and terminates the scan by passing
-// back a nil pointer that will be the next state, terminating l.nextItem.
-func (l *lexer) errorf(format string, args ...interface{}) stateFn {
-	l.items <- item{itemError, fmt.Sprintf(format, args...)}
-	return nil
+// errorf emits an error item describing a problem at pos, and
+// returns the state that resumes the scan on the line after pos.
+func (l *lexer) errorf(
+	kind base.DiagnosticKind, pos position, format string, args ...interface{}) stateFn {
+	l.items <- item{typ: itemError, val: fmt.Sprintf(format, args...), pos: pos, kind: kind}
+	l.current = pos
+	return lexSkipLine
+}
+
+// lexSkipLine drops the rest of the current line, so that scanning
+// can resume after an error.
+func lexSkipLine(l *lexer) stateFn {
+	if i := strings.IndexByte(l.input[l.current:], '\n'); i >= 0 {
+		l.current += position(i + 1)
+	} else {
+		l.current = position(len(l.input))
+	}
+	l.ignore()
+	return lexText
 }
 
 // nextItem returns the next item from the input.
@@ -165,6 +204,101 @@ func (l *lexer) run() {
 	}
 }
 
+// A fence opens or closes a fenced code block.  Per CommonMark, it's
+// a run of at least three backticks or three tildes, indented by at
+// most three spaces.  A code block is closed only by a fence of the
+// same character, at least as long as the opening one, followed by
+// nothing but spaces; see base.Fence.  An opening backtick fence's
+// info string can't hold backticks, so that inline code isn't taken
+// for a fence.
+type fence struct {
+	indent int // Spaces before the fence.
+	base.Fence
+}
+
+const minFenceLength = 3
+
+// parseFence returns the fence at the start of line, if any, and
+// what follows it.
+func parseFence(line string) (fence, string, bool) {
+	f := fence{}
+	for f.indent < len(line) && line[f.indent] == ' ' {
+		f.indent++
+	}
+	if f.indent == len(line) || (line[f.indent] != '`' && line[f.indent] != '~') {
+		return f, "", false
+	}
+	f.Char = line[f.indent]
+	for f.indent+f.Length < len(line) && line[f.indent+f.Length] == f.Char {
+		f.Length++
+	}
+	if f.Length < minFenceLength {
+		return f, "", false
+	}
+	return f, line[f.indent+f.Length:], true
+}
+
+// closedBy returns the length of line, less any line ending, if line
+// closes a code block opened by f, else zero.
+func (f fence) closedBy(line string) int {
+	rel := line
+	for i := 0; i < f.indent && strings.HasPrefix(rel, " "); i++ {
+		rel = rel[1:]
+	}
+	if !f.ClosedBy(rel) {
+		return 0
+	}
+	return len(strings.TrimRight(line, "\r"))
+}
+
+// currentLine returns the rest of the line at the current position,
+// without its line ending.
+func (l *lexer) currentLine() string {
+	line := l.input[l.current:]
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	return strings.TrimRight(line, "\r")
+}
+
+func (l *lexer) atLineStart() bool {
+	return l.current == 0 || l.input[l.current-1] == '\n'
+}
+
+// openingFence returns true, saving the fence in l.fence, if the line
+// at the current position opens a code block.  Within a list item, the
+// fence may be indented by as much as the item's content, plus three.
+func (l *lexer) openingFence() bool {
+	f, info, ok := parseFence(l.currentLine())
+	if !ok || f.indent > l.listIndent+base.MaxFenceIndent ||
+		(f.Char == '`' && strings.ContainsRune(info, '`')) {
+		return false
+	}
+	l.fence = f
+	return true
+}
+
+// listItem matches the start of a list item, capturing everything
+// before the item's content.
+var listItem = regexp.MustCompile(`^ *(?:[-+*]|[0-9]{1,9}[.)]) +`)
+
+// trackListItem follows list items in prose, to know how far a fence
+// in a list item may be indented.  A line starting a list item sets
+// the indentation; a non-blank line indented less ends the item.
+func (l *lexer) trackListItem() {
+	line := l.currentLine()
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	if m := listItem.FindString(line); m != "" && len(m) < len(line) {
+		l.listIndent = len(m)
+		return
+	}
+	if len(line)-len(strings.TrimLeft(line, " ")) < l.listIndent {
+		l.listIndent = 0
+	}
+}
+
 func isSpace(r rune) bool {
 	return r == ' ' || r == '\t'
 }
@@ -173,22 +307,27 @@ func isEndOfLine(r rune) bool {
 	return r == '\r' || r == '\n'
 }
 
-// lexText scans until an opening comment delimiter.
+// lexText scans prose, line by line, until an opening comment
+// delimiter or an opening code fence.
 func lexText(l *lexer) stateFn {
 	for {
-		if strings.HasPrefix(l.input[l.current:], commentOpen) {
-			if l.current > l.start {
-				l.emit(itemProse)
+		if l.atLineStart() {
+			if l.openingFence() {
+				if l.current > l.start {
+					l.emit(itemProse)
+				}
+				return lexCodeBlock
 			}
-			return lexPutativeComment
+			l.trackListItem()
 		}
-		if strings.HasPrefix(l.input[l.current:], codeFence) {
+		rest := l.input[l.current:]
+		if strings.HasPrefix(rest, commentOpen) {
 			if l.current > l.start {
 				l.emit(itemProse)
 			}
-			return lexCodeBlock
+			return lexPutativeComment
 		}
-		if l.next() == eof {
+		if len(rest) == 0 {
 			if l.current > l.start {
 				l.emit(itemProse)
 			}
@@ -196,13 +335,22 @@ func lexText(l *lexer) stateFn {
 			l.emit(itemEOF)
 			return nil
 		}
-		l.acceptRun(mdPunct + lettersAndNumbers)
+		// Skip to the next comment or line, whichever comes first.
+		step := len(rest)
+		if i := strings.IndexByte(rest, '\n'); i >= 0 {
+			step = i + 1
+		}
+		if i := strings.Index(rest, commentOpen); i >= 0 && i < step {
+			step = i
+		}
+		l.current += position(step)
 	}
 }
 
 // Move to lexing a command block intended for a particular label, or to
 // lexing a simple comment.  Comment opener known to be present.
 func lexPutativeComment(l *lexer) stateFn {
+	l.comment = l.current
 	l.current += position(len(commentOpen))
 	for {
 		switch r := l.next(); {
@@ -223,85 +371,275 @@ func lexPutativeComment(l *lexer) stateFn {
 func lexCommentRemainder(l *lexer) stateFn {
 	i := strings.Index(l.input[l.current:], commentClose)
 	if i < 0 {
-		return l.errorf("unclosed comment")
+		return l.errorf(base.UnclosedComment, l.comment, "unclosed comment")
 	}
 	l.current += position(i + len(commentClose))
 	l.ignore()
 	return lexText
 }
 
-// lexBlockLabels scans a string like "@1 @hey" emitting the labels
-// "1" and "hey".  LabelMarker known to be present.
+// lexBlockLabels scans a string like "@1 @hey @exit=2 dir=/tmp"
+// emitting the labels "1", "hey" and "exit", the latter followed by
+// the value "2", then the attribute key "dir" and its value "/tmp".
+// LabelMarker known to be present.
 func lexBlockLabels(l *lexer) stateFn {
 	for {
 		switch r := l.next(); {
 		case r == eof || isEndOfLine(r):
-			return l.errorf("unclosed block label sequence")
+			l.backup()
+			return l.errorf(base.UnclosedLabels, l.current, "unclosed block label sequence")
 		case isSpace(r):
 			l.ignore()
 		case r == labelMarker:
 			l.ignore()
 			l.acceptRun("_" + lettersAndNumbers)
-			if l.width == 0 {
-				return l.errorf("empty block label")
+			if l.current == l.start {
+				return l.errorf(base.EmptyLabel, l.current-1, "empty block label")
 			}
 			l.emit(itemBlockLabel)
+			if l.peek() == labelValueOp {
+				l.next()
+				l.ignore()
+				l.acceptRun(labelValueChars)
+				if l.current == l.start {
+					return l.errorf(base.EmptyLabelValue, l.current-1, "empty block label value")
+				}
+				l.emit(itemLabelValue)
+			}
+		case isAttrKeyStart(r):
+			l.backup()
+			return lexAttribute
 		default:
 			l.backup()
 			if !strings.HasPrefix(l.input[l.current:], commentClose) {
-				return l.errorf("improperly closed block label sequence")
+				return l.errorf(base.BadLabelsClose, l.current, "improperly closed block label sequence")
 			}
 			l.current += position(len(commentClose))
 			l.ignore()
 			l.acceptRun(" \t")
 			l.ignore()
 			r := l.next()
-			if r != '\n' && r != '\r' {
-				return l.errorf("Expected command block marker at start of line.")
+			if r == '\r' {
+				l.accept("\n")
+			} else if r != '\n' {
+				l.backup()
+				return l.errorf(base.LabelsWithoutCode, l.current,
+					"block labels must be alone on their line")
 			}
 			l.ignore()
-			if !strings.HasPrefix(l.input[l.current:], codeFence) {
-				return l.errorf("Expected command block mark, got: " + l.input[l.current:])
+			if !l.openingFence() {
+				// Resume with this line, as it may be prose.
+				next := l.current
+				l.errorf(base.LabelsWithoutCode, l.comment,
+					"block labels must be followed by a code fence")
+				l.current = next
+				l.ignore()
+				return lexText
 			}
 			return lexCodeBlock
 		}
 	}
 }
 
-// lexCodeBlock scans a command block.  Initial marker known to be present.
+// isAttrKeyStart is true if r can start an attribute key.
+func isAttrKeyStart(r rune) bool {
+	return r == '_' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z'
+}
+
+// lexAttribute scans an attribute like dir=/tmp/x, env=FOO=bar or
+// skip-if="! command -v docker", emitting its key and its value.  An
+// unquoted value runs to the next space or the comment closer.  A
+// quoted value may hold spaces, and backslash escapes a quote or a
+// backslash in it; the emitted value is unquoted.  Either way, the
+// value can't span lines.
+func lexAttribute(l *lexer) stateFn {
+	l.acceptRun(attrKeyChars)
+	key := l.input[l.start:l.current]
+	l.emit(itemAttrKey)
+	if l.next() != labelValueOp {
+		l.backup()
+		return l.errorf(base.BadAttribute, l.start-position(len(key)),
+			"attribute %q needs a value, as in %s=...", key, key)
+	}
+	l.ignore()
+	if l.peek() != attrQuote {
+		for !strings.HasPrefix(l.input[l.current:], commentClose) {
+			if r := l.next(); r == eof || isSpace(r) || isEndOfLine(r) {
+				l.backup()
+				break
+			}
+		}
+		if l.current == l.start {
+			return l.errorf(base.BadAttribute, l.current-1,
+				"empty value for attribute %q", key)
+		}
+		l.emit(itemAttrValue)
+		return lexBlockLabels
+	}
+	l.next()
+	var v strings.Builder
+	for {
+		r := l.next()
+		if r == '\\' && (l.peek() == attrQuote || l.peek() == '\\') {
+			r = l.next()
+		} else if r == attrQuote {
+			break
+		} else if r == eof || isEndOfLine(r) {
+			l.backup()
+			return l.errorf(base.BadAttribute, l.start,
+				"unclosed quote in value of attribute %q", key)
+		}
+		v.WriteRune(r)
+	}
+	l.items <- item{typ: itemAttrValue, val: v.String(), pos: l.start}
+	l.ignore()
+	return lexBlockLabels
+}
+
+// lexCodeBlock scans a command block.  The opening fence, in
+// l.fence, is known to be present.
 func lexCodeBlock(l *lexer) stateFn {
-	l.current += position(len(codeFence))
+	f := l.fence
+	open := l.current + position(f.indent)
+	l.current = open + position(f.Length)
 	l.ignore()
-	// Ignore any language specifier.
+	// Emit any info string, e.g. a language specifier.
 	if idx := strings.Index(l.input[l.current:], "\n"); idx > -1 {
-		l.current += position(idx) + 1
+		eol := l.current + position(idx)
+		l.acceptRun(" \t")
+		l.ignore()
+		if info := strings.TrimRight(l.input[l.current:eol], " \t\r"); len(info) > 0 {
+			l.current += position(len(info))
+			l.emit(itemCodeInfo)
+		}
+		l.current = eol + 1
 		l.ignore()
 	}
 	for {
-		if strings.HasPrefix(l.input[l.current:], codeFence) {
-			if l.current > l.start {
-				l.emit(itemCodeBlock)
-			}
-			l.current += position(len(codeFence))
+		line := l.input[l.current:]
+		if i := strings.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i]
+		}
+		if n := f.closedBy(line); n > 0 {
+			// Emit even if empty, so labels don't leak to the next block.
+			l.items <- item{typ: itemCodeBlock, val: l.input[l.start:l.current],
+				pos: l.start, indent: f.indent, fence: f.Fence, open: open}
+			l.current += position(n)
 			l.ignore()
 			return lexText
 		}
-		if l.next() == eof {
-			return l.errorf("unclosed command block")
+		if int(l.current)+len(line) >= len(l.input) {
+			return l.errorf(base.UnclosedBlock, open, "unclosed command block")
+		}
+		l.current += position(len(line) + 1)
+	}
+}
+
+// outputInfo is the info string of a fence holding expected output.
+const outputInfo = "output"
+
+// outputFenceMode returns true and the match mode if the labels and
+// info string of a fenced block mark it as the expected output of the
+// preceding block, rather than as code.  The mode is "exact" unless a
+// label or a word following "output" in the info string names
+// another mode, e.g. "output regexp" or "<!-- @expect @contains -->".
+func outputFenceMode(labels []base.Label, info string) (base.MatchMode, bool) {
+	words := strings.Fields(info)
+	isOutput := len(words) > 0 && words[0] == outputInfo
+	if len(words) > 0 {
+		words = words[1:]
+	}
+	for _, l := range labels {
+		if l == base.ExpectLabel {
+			isOutput = true
+		}
+		words = append(words, string(l))
+	}
+	if !isOutput {
+		return base.MatchExact, false
+	}
+	mode := base.MatchExact
+	for _, w := range words {
+		if m, ok := base.MatchModeFromString(w); ok {
+			mode = m
 		}
 	}
+	return mode, true
 }
 
-// Parse lexes the incoming string into a list of model.BlockParsed.
-func Parse(s string) (result []*model.BlockParsed) {
+// languageOf returns the language named by a fence's info string,
+// i.e. its first word, lower cased, e.g. "python" for "Python" or
+// for "{.python}".
+func languageOf(info string) string {
+	words := strings.Fields(info)
+	if len(words) == 0 {
+		return ""
+	}
+	return strings.ToLower(strings.Trim(words[0], "{}."))
+}
+
+// fenceFor returns a backtick fence long enough to enclose code.
+func fenceFor(code string) string {
+	n := len(codeFence)
+	for _, line := range strings.Split(code, "\n") {
+		if f, _, ok := parseFence(line); ok && f.Char == '`' && f.Length >= n {
+			n = f.Length + 1
+		}
+	}
+	return strings.Repeat("`", n)
+}
+
+// Parse lexes the incoming string into a list of model.BlockParsed,
+// ignoring any problems found.
+func Parse(s string) []*model.BlockParsed {
+	result, _ := ParseFile("", s)
+	return result
+}
+
+// ParseFile lexes the contents of the given file into a list of
+// model.BlockParsed, each knowing where in the file it came from.
+//
+// Fenced blocks holding expected output (see outputFenceMode) don't
+// become blocks of their own; they're attached to the preceding block,
+// and otherwise treated as prose.  Only blank lines and label comments
+// may come between the two; an output fence following anything else
+// is kept as prose, with a diagnostic, rather than checked against a
+// block it may have nothing to do with.
+//
+// A problem, e.g. a malformed label comment, doesn't stop the parse.
+// It's described in a diagnostic, any labels or info string pending
+// at the time are dropped, and parsing resumes on the next line.
+func ParseFile(f base.FilePath, s string) (
+	result []*model.BlockParsed, diags []base.Diagnostic) {
 	result = []*model.BlockParsed{}
 	prose := ""
+	info := ""
 	labels := []base.Label{}
+	args := map[base.Label]string{}
+	attrs := base.Attributes{}
+	key := ""
+	lines := base.NewLineIndex(s)
+	locate := func(p position) base.Location {
+		return lines.Location(int(p)).InFile(f)
+	}
+	labelLoc := base.Location{}
 	l := newLex(s)
 	for {
 		item := l.nextItem()
 		switch {
-		case item.typ == itemEOF || item.typ == itemError:
+		case item.typ == itemError:
+			loc := locate(item.pos)
+			diags = append(diags, base.Diagnostic{
+				Kind:     item.kind,
+				Location: loc,
+				Snippet:  util.SampleString(lines.Line(loc.Line), 60),
+				Message:  item.val})
+			labels = []base.Label{}
+			args = map[base.Label]string{}
+			attrs = base.Attributes{}
+			labelLoc = base.Location{}
+			info = ""
+		case item.typ == itemEOF:
 			prose = strings.TrimSpace(prose)
 			if len(prose) > 0 {
 				// Hack to grab the last bit of prose.
@@ -310,15 +648,56 @@ func Parse(s string) (result []*model.BlockParsed) {
 			}
 			return
 		case item.typ == itemBlockLabel:
+			if len(labels) == 0 {
+				labelLoc = locate(item.pos - 1)
+				labelLoc.EndLine = labelLoc.Line
+			}
 			labels = append(labels, base.Label(item.val))
+		case item.typ == itemLabelValue:
+			args[labels[len(labels)-1]] = item.val
+		case item.typ == itemAttrKey:
+			key = item.val
+		case item.typ == itemAttrValue:
+			attrs.Add(key, item.val)
 		case item.typ == itemProse:
-			prose = item.val
+			prose += item.val
+		case item.typ == itemCodeInfo:
+			info = item.val
 		case item.typ == itemCodeBlock:
-			result = append(
-				result,
-				model.NewBlockParsed(labels, base.MdProse(prose), base.OpaqueCode(item.val)))
+			code := util.Dedent(item.val, item.indent)
+			if mode, ok := outputFenceMode(labels, info); ok {
+				if n := len(result); n == 0 || strings.TrimSpace(prose) != "" {
+					loc := locate(item.open)
+					diags = append(diags, base.Diagnostic{
+						Kind:     base.DetachedOutput,
+						Location: loc,
+						Snippet:  util.SampleString(lines.Line(loc.Line), 60),
+						Message:  "output fence doesn't directly follow a command block"})
+				} else {
+					result[n-1].SetExpected(
+						base.NewExpectedOutput(mode, code).SetSpan(base.Span{
+							Start: int(item.pos), End: int(item.pos) + len(item.val)}).
+							SetIndent(item.indent).SetFence(item.fence))
+				}
+				marks := fenceFor(code)
+				prose += marks + info + "\n" + code + marks + "\n"
+			} else {
+				b := model.NewBlockParsed(labels, base.MdProse(prose), base.OpaqueCode(code))
+				b.SetLabelArgs(args)
+				b.SetAttributes(attrs)
+				b.SetLanguage(languageOf(info))
+				loc := locate(item.open)
+				loc.EndLine = locate(item.pos + position(len(item.val))).Line
+				b.SetLocation(loc)
+				b.SetLabelLocation(labelLoc)
+				result = append(result, b)
+				prose = ""
+			}
 			labels = []base.Label{}
-			prose = ""
+			args = map[base.Label]string{}
+			attrs = base.Attributes{}
+			labelLoc = base.Location{}
+			info = ""
 		}
 	}
 }
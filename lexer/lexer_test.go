@@ -3,6 +3,8 @@ package lexer
 import (
 	"fmt"
 	"testing"
+
+	"github.com/monopole/mdrip/base"
 )
 
 type lexTest struct {
@@ -11,59 +13,77 @@ type lexTest struct {
 	want  []item // Expected items produced by lexer.
 }
 
+// Per CommonMark, a closing fence must start its own line, so each
+// block ends with a newline.
 const (
 	block1 = "echo $PATH\n" +
-		"echo $GOPATH"
-	block2 = "kill -9 $pid"
+		"echo $GOPATH\n"
+	block2 = "kill -9 $pid\n"
 )
 
 var (
-	tEOF = item{itemEOF, ""}
+	tEOF = item{typ: itemEOF, val: ""}
 )
 
 var lexTests = []lexTest{
 	{"empty", "", []item{tEOF}},
-	{"spaces", " \t\n", []item{{itemProse, " \t\n"}, tEOF}},
+	{"spaces", " \t\n", []item{{typ: itemProse, val: " \t\n"}, tEOF}},
 	{"text", "blah blah",
-		[]item{{itemProse, "blah blah"}, tEOF}},
+		[]item{{typ: itemProse, val: "blah blah"}, tEOF}},
 	{"comment1", "<!-- -->", []item{tEOF}},
-	{"comment2", "a <!-- --> b", []item{{itemProse, "a "}, {itemProse, " b"}, tEOF}},
+	{"comment2", "a <!-- --> b", []item{{typ: itemProse, val: "a "}, {typ: itemProse, val: " b"}, tEOF}},
 	{"block1", "fred <!-- @1 -->\n" +
 		"```\n" + block1 + "```\n bbb",
 		[]item{
-			{itemProse, "fred "},
-			{itemBlockLabel, "1"},
-			{itemCodeBlock, block1},
-			{itemProse, "\n bbb"},
+			{typ: itemProse, val: "fred "},
+			{typ: itemBlockLabel, val: "1"},
+			{typ: itemCodeBlock, val: block1},
+			{typ: itemProse, val: "\n bbb"},
 			tEOF}},
 	{"block2", "aa <!-- @1 @2-->\n" +
 		"```\n" + block1 + "```\n bb cc\n" +
 		"dd <!-- @3 @4-->\n" +
 		"```\n" + block2 + "```\n ee ff\n",
 		[]item{
-			{itemProse, "aa "},
-			{itemBlockLabel, "1"},
-			{itemBlockLabel, "2"},
-			{itemCodeBlock, block1},
-			{itemProse, "\n bb cc\ndd "},
-			{itemBlockLabel, "3"},
-			{itemBlockLabel, "4"},
-			{itemCodeBlock, block2},
-			{itemProse, "\n ee ff\n"},
+			{typ: itemProse, val: "aa "},
+			{typ: itemBlockLabel, val: "1"},
+			{typ: itemBlockLabel, val: "2"},
+			{typ: itemCodeBlock, val: block1},
+			{typ: itemProse, val: "\n bb cc\ndd "},
+			{typ: itemBlockLabel, val: "3"},
+			{typ: itemBlockLabel, val: "4"},
+			{typ: itemCodeBlock, val: block2},
+			{typ: itemProse, val: "\n ee ff\n"},
+			tEOF}},
+	{"blockWithLabelValue", "<!-- @fails @exit=2 @t=1.5m -->\n" +
+		"```\n" + block2 + "```\n",
+		[]item{
+			{typ: itemBlockLabel, val: "fails"},
+			{typ: itemBlockLabel, val: "exit"},
+			{typ: itemLabelValue, val: "2"},
+			{typ: itemBlockLabel, val: "t"},
+			{typ: itemLabelValue, val: "1.5m"},
+			{typ: itemCodeBlock, val: block2},
+			{typ: itemProse, val: "\n"},
 			tEOF}},
+	{"blockWithEmptyLabelValue", "<!-- @exit= -->\n```\n" + block2 + "```\n",
+		[]item{
+			{typ: itemBlockLabel, val: "exit"},
+			{typ: itemError, val: "empty block label value"}}},
 	{"blockWithLangName", "Hello <!-- @1 -->\n" +
 		"```java\nvoid main whatever\n```",
 		[]item{
-			{itemProse, "Hello "},
-			{itemBlockLabel, "1"},
-			{itemCodeBlock, "void main whatever\n"},
+			{typ: itemProse, val: "Hello "},
+			{typ: itemBlockLabel, val: "1"},
+			{typ: itemCodeInfo, val: "java"},
+			{typ: itemCodeBlock, val: "void main whatever\n"},
 			tEOF}},
 	{"blockNoLabel", "fred\n" +
 		"```\n" + block1 + "```\n bbb",
 		[]item{
-			{itemProse, "fred\n"},
-			{itemCodeBlock, block1},
-			{itemProse, "\n bbb"},
+			{typ: itemProse, val: "fred\n"},
+			{typ: itemCodeBlock, val: block1},
+			{typ: itemProse, val: "\n bbb"},
 			tEOF}},
 }
 
@@ -115,3 +135,289 @@ func TestLex(t *testing.T) {
 		}
 	}
 }
+
+type parseTest struct {
+	name     string
+	input    string
+	codes    []string
+	expected []string // Expected output text of each block, if any.
+	modes    []base.MatchMode
+}
+
+var parseTests = []parseTest{
+	{"noOutput",
+		"<!-- @1 -->\n```\necho hi\n```\n",
+		[]string{"echo hi\n"}, []string{""}, nil},
+	{"outputInfo",
+		"<!-- @1 -->\n```\necho hi\n```\n\n```output\nhi\n```\nthen\n```\nls\n```\n",
+		[]string{"echo hi\n", "ls\n"}, []string{"hi\n", ""},
+		[]base.MatchMode{base.MatchExact, base.MatchExact}},
+	{"outputAfterProse",
+		"<!-- @1 -->\n```\necho hi\n```\nGives\n```output\nhi\n```\nthen\n```\nls\n```\n",
+		[]string{"echo hi\n", "ls\n"}, []string{"", ""}, nil},
+	{"outputRegexp",
+		"```\ndate\n```\n```output regexp\n^[A-Z]\n```\n",
+		// The output fence lands in trailing prose.
+		[]string{"date\n", ""}, []string{"^[A-Z]\n", ""},
+		[]base.MatchMode{base.MatchRegexp, base.MatchExact}},
+	{"expectLabel",
+		"```\necho hello world\n```\n<!-- @expect @contains -->\n```\nworld\n```\n",
+		[]string{"echo hello world\n", ""}, []string{"world\n", ""},
+		[]base.MatchMode{base.MatchContains, base.MatchExact}},
+	{"outputWithNothingBefore",
+		"Hey\n```output\nhi\n```\n",
+		[]string{""}, []string{""}, nil},
+}
+
+func TestParseExpectedOutput(t *testing.T) {
+	for _, test := range parseTests {
+		got := Parse(test.input)
+		if len(got) != len(test.codes) {
+			t.Errorf("%s: got %d blocks, want %d", test.name, len(got), len(test.codes))
+			continue
+		}
+		for i, b := range got {
+			if b.Code().String() != test.codes[i] {
+				t.Errorf("%s: block %d code got %q, want %q",
+					test.name, i, b.Code(), test.codes[i])
+			}
+			e := b.Expected()
+			if len(test.expected[i]) == 0 {
+				if e != nil {
+					t.Errorf("%s: block %d unexpected expectation %q", test.name, i, e.Text())
+				}
+				continue
+			}
+			if e == nil || e.Text() != test.expected[i] || e.Mode() != test.modes[i] {
+				t.Errorf("%s: block %d got expectation %+v, want %q (%v)",
+					test.name, i, e, test.expected[i], test.modes[i])
+			}
+		}
+	}
+}
+
+func TestParseDetachedOutput(t *testing.T) {
+	input := "```output\nhi\n```\n" +
+		"```\necho hi\n```\n" +
+		"Gives\n\n" +
+		"<!-- @expect -->\n```\nhi\n```\n" +
+		"```\necho bye\n```\n\n" +
+		"<!-- @expect -->\n```\nbye\n```\n" +
+		"```output\nbye again\n```\n"
+	got, diags := ParseFile("a.md", input)
+	if len(got) != 3 || got[0].Expected() != nil || got[1].Expected() == nil ||
+		got[1].Expected().Text() != "bye\n" {
+		t.Errorf("expected only the second block to get output, got %v", got)
+	}
+	wantLines := []int{1, 10, 21}
+	if len(diags) != len(wantLines) {
+		t.Fatalf("got %d diagnostics, want %d: %v", len(diags), len(wantLines), diags)
+	}
+	for i, d := range diags {
+		if d.Kind != base.DetachedOutput || d.Location.Line != wantLines[i] {
+			t.Errorf("diagnostic %d: got %v (%s), want %s at line %d",
+				i, d, d.Kind, base.DetachedOutput, wantLines[i])
+		}
+	}
+}
+
+func TestParseLanguage(t *testing.T) {
+	got := Parse("```\nls\n```\n" +
+		"```python\nprint(1)\n```\n" +
+		"```{.Go}\nfunc main() {}\n```\n" +
+		"```sh some other words\nls\n```\n")
+	want := []string{"", "python", "go", "sh"}
+	if len(got) != len(want) {
+		t.Fatalf("got %d blocks, want %d", len(got), len(want))
+	}
+	for i, b := range got {
+		if b.Language() != want[i] {
+			t.Errorf("block %d: got language %q, want %q", i, b.Language(), want[i])
+		}
+	}
+}
+
+// fenceTests are mostly from the CommonMark spec's fenced code block
+// examples; see https://spec.commonmark.org/0.29/#fenced-code-blocks
+var fenceTests = []struct {
+	name  string
+	input string
+	codes []string
+}{
+	{"backticks", "```\n<\n >\n```\n", []string{"<\n >\n"}},
+	{"tildes", "~~~\n<\n >\n~~~\n", []string{"<\n >\n"}},
+	{"tooShort", "``\nfoo\n``\n", nil},
+	{"inlineCode", "Run ```ls``` now.\n", nil},
+	{"tildeDoesNotCloseBackticks", "```\naaa\n~~~\n```\n", []string{"aaa\n~~~\n"}},
+	{"backticksDoNotCloseTildes", "~~~\naaa\n```\n~~~\n", []string{"aaa\n```\n"}},
+	{"closingAtLeastAsLong", "````\naaa\n```\n``````\n", []string{"aaa\n```\n"}},
+	{"tildesAtLeastAsLong", "~~~~\naaa\n~~~\n~~~~\n", []string{"aaa\n~~~\n"}},
+	{"nested", "````markdown\n```\nls\n```\n````\n", []string{"```\nls\n```\n"}},
+	{"blankLines", "```\n\n  \n```\n", []string{"\n  \n"}},
+	{"indentOne", " ```\n aaa\naaa\n```\n", []string{"aaa\naaa\n"}},
+	{"indentTwo", "  ```\naaa\n  aaa\naaa\n  ```\n", []string{"aaa\naaa\naaa\n"}},
+	{"indentThree", "   ```\n   aaa\n    aaa\n  aaa\n   ```\n", []string{"aaa\n aaa\naaa\n"}},
+	{"indentFour", "    ```\n    aaa\n    ```\n", nil},
+	{"closingIndented", "```\naaa\n  ```\n", []string{"aaa\n"}},
+	{"closingIndentedRelative", "   ```\naaa\n  ```\n", []string{"aaa\n"}},
+	{"closingTooIndented", "```\naaa\n    ```\n```\n", []string{"aaa\n    ```\n"}},
+	{"closingWithInfo", "```\naaa\n``` aaa\n```\n", []string{"aaa\n``` aaa\n"}},
+	{"closingTrailingSpaces", "```\naaa\n```   \nbbb\n", []string{"aaa\n"}},
+	{"backtickInInfo", "``` aa ```\nfoo\n", nil},
+	{"tildeInfoMayHoldBackticks", "~~~ aa ``` ~~~\nfoo\n~~~\n", []string{"foo\n"}},
+	{"listItem",
+		"1. Install it:\n\n   ```\n   go get foo\n     --flag\n   ```\n\n2. Run it.\n",
+		[]string{"go get foo\n  --flag\n"}},
+	{"nestedListItem",
+		"- One\n\n  - Two\n\n      ```\n      ls\n      ```\n",
+		[]string{"ls\n"}},
+	{"afterListItem",
+		"- One\n\nMore prose.\n\n    ```\n    ls\n    ```\n", nil},
+	{"labelledListItem",
+		"1. Do:\n   <!-- @one -->\n   ```\n   ls\n   ```\n",
+		[]string{"ls\n"}},
+}
+
+func TestParseFences(t *testing.T) {
+	for _, test := range fenceTests {
+		codes := []string{}
+		for _, b := range Parse(test.input) {
+			if b.Code() != base.NoCode() {
+				codes = append(codes, b.Code().String())
+			}
+		}
+		if fmt.Sprint(codes) != fmt.Sprint(test.codes) || len(codes) != len(test.codes) {
+			t.Errorf("%s: got %q, want %q", test.name, codes, test.codes)
+		}
+	}
+}
+
+func TestParseLocations(t *testing.T) {
+	got, _ := ParseFile("a.md", "# Title\n\n"+
+		"```\nls\n```\n\n"+
+		"1. Then\n   <!-- @one @two -->\n   ~~~~\n   date\n\n   ~~~~\n")
+	if len(got) != 2 {
+		t.Fatalf("got %d blocks, want 2", len(got))
+	}
+	want := []struct{ fence, labels base.Location }{
+		{base.Location{File: "a.md", Line: 3, Column: 1, EndLine: 5}, base.Location{}},
+		{base.Location{File: "a.md", Line: 9, Column: 4, EndLine: 12},
+			base.Location{File: "a.md", Line: 8, Column: 9, EndLine: 8}},
+	}
+	for i, b := range got {
+		if b.Location() != want[i].fence {
+			t.Errorf("block %d: got fence at %+v, want %+v", i, b.Location(), want[i].fence)
+		}
+		if b.LabelLocation() != want[i].labels {
+			t.Errorf("block %d: got labels at %+v, want %+v", i, b.LabelLocation(), want[i].labels)
+		}
+	}
+	if s := got[1].Location().String(); s != "a.md:9" {
+		t.Errorf("got %q", s)
+	}
+}
+
+func TestParseRecovers(t *testing.T) {
+	input := "# Title\n" + // 1
+		"<!-- @one @two\n" + // 2
+		"```\necho one\n```\n" + // 3-5
+		"<!-- @three -->\n" + // 6
+		"Not a fence.\n" + // 7
+		"<!-- @four @ -->\n" + // 8
+		"```\necho four\n```\n" + // 9-11
+		"<!-- @five --> oops\n" + // 12
+		"<!-- @six=\t-->\n" + // 13
+		"<!-- @seven -->\n" + // 14
+		"```\necho seven\n```\n" + // 15-17
+		"<!-- @eight ! -->\n" + // 18
+		"```sh\nnever closed\n" + // 19-20
+		"<!-- not closed either\n" // 21
+	got, diags := ParseFile("a.md", input)
+	codes := []string{}
+	names := []string{}
+	for _, b := range got {
+		if b.Code() != base.NoCode() {
+			codes = append(codes, b.Code().String())
+			names = append(names, fmt.Sprint(b.Labels()))
+		}
+	}
+	wantCodes := []string{"echo one\n", "echo four\n", "echo seven\n"}
+	wantNames := []string{"[]", "[]", "[seven]"}
+	if fmt.Sprint(codes) != fmt.Sprint(wantCodes) || fmt.Sprint(names) != fmt.Sprint(wantNames) {
+		t.Errorf("got blocks %q labelled %v, want %q labelled %v",
+			codes, names, wantCodes, wantNames)
+	}
+	wantDiags := []struct {
+		kind   base.DiagnosticKind
+		line   int
+		column int
+	}{
+		{base.UnclosedLabels, 2, 15},
+		{base.LabelsWithoutCode, 6, 1},
+		{base.EmptyLabel, 8, 12},
+		{base.LabelsWithoutCode, 12, 16},
+		{base.EmptyLabelValue, 13, 10},
+		{base.BadLabelsClose, 18, 13},
+		{base.UnclosedBlock, 19, 1},
+		{base.UnclosedComment, 21, 1},
+	}
+	if len(diags) != len(wantDiags) {
+		t.Fatalf("got %d diagnostics, want %d: %v", len(diags), len(wantDiags), diags)
+	}
+	for i, d := range diags {
+		w := wantDiags[i]
+		if d.Kind != w.kind || d.Location.Line != w.line ||
+			d.Location.Column != w.column || d.Location.File != "a.md" {
+			t.Errorf("diagnostic %d: got %v (%s), want %s at %d:%d",
+				i, d, d.Kind, w.kind, w.line, w.column)
+		}
+	}
+	if s := diags[6].String(); s != `a.md:19:1: unclosed command block: "`+"```sh"+`"` {
+		t.Errorf("got %q", s)
+	}
+}
+
+func TestParseAttributes(t *testing.T) {
+	input := `<!-- @server timeout=30s dir=/tmp/x env=FOO=bar env=A=1 skip-if="! command -v \"docker\"" -->
+` + "```\necho one\n```\n" + `<!-- @two k=v-->
+` + "```\necho two\n```\n" + `<!-- @three dir -->
+` + "```\necho three\n```\n" + `<!-- @four k="oops -->
+` + "```\necho four\n```\n" + `<!-- @five k= -->
+` + "```\necho five\n```\n"
+	got, diags := ParseFile("a.md", input)
+	if len(got) != 5 {
+		t.Fatalf("got %d blocks, want 5", len(got))
+	}
+	want := []base.Attributes{
+		{
+			"timeout": {"30s"},
+			"dir":     {"/tmp/x"},
+			"env":     {"FOO=bar", "A=1"},
+			"skip-if": {`! command -v "docker"`},
+		},
+		{"k": {"v"}},
+		{}, {}, {},
+	}
+	for i, b := range got {
+		if fmt.Sprint(b.Attributes()) != fmt.Sprint(want[i]) {
+			t.Errorf("block %d: got attributes %v, want %v", i+1, b.Attributes(), want[i])
+		}
+	}
+	if s := fmt.Sprint(got[0].Labels()); s != "[server]" {
+		t.Errorf("got labels %s, want [server]", s)
+	}
+	wantDiags := []struct {
+		line   int
+		column int
+	}{{9, 13}, {13, 14}, {17, 13}}
+	if len(diags) != len(wantDiags) {
+		t.Fatalf("got %d diagnostics, want %d: %v", len(diags), len(wantDiags), diags)
+	}
+	for i, d := range diags {
+		w := wantDiags[i]
+		if d.Kind != base.BadAttribute || d.Location.Line != w.line || d.Location.Column != w.column {
+			t.Errorf("diagnostic %d: got %v (%s), want %s at %d:%d",
+				i, d, d.Kind, base.BadAttribute, w.line, w.column)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+// Package lint finds problems in markdown files that would stop their
+// command blocks from being extracted or run as their authors intend,
+// without running anything.
+package lint
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/monopole/mdrip/base"
+	"github.com/monopole/mdrip/model"
+	"github.com/monopole/mdrip/program"
+	"github.com/monopole/mdrip/util"
+)
+
+// Lint returns the problems found in every lesson of the tutorial,
+// ordered by file and line.  These include the problems found while
+// parsing, and:
+//
+//   - unlabelled blocks in a file whose other blocks have labels;
+//   - labels used just once in the whole tutorial, other than as a
+//     block's name (its first label), as these are likely typos;
+//   - attributes mdrip doesn't know, e.g. a misspelt skip-if;
+//   - trailing whitespace, and carriage returns, in blocks;
+//   - blocks that bash -n finds syntax errors in.
+func Lint(t model.Tutorial) []base.Diagnostic {
+	c := &lessonCollector{}
+	t.Accept(c)
+	result := []base.Diagnostic{}
+	for _, l := range c.lessons {
+		result = append(result, l.Diagnostics()...)
+		result = append(result, unlabelledBlocks(l)...)
+		for _, b := range fencedBlocks(l) {
+			result = append(result, unknownAttrs(b)...)
+			result = append(result, badSpace(b)...)
+			result = append(result, shellSyntax(b)...)
+		}
+	}
+	result = append(result, loneLabels(c.lessons)...)
+	sort.SliceStable(result, func(i, j int) bool {
+		a, b := result[i].Location, result[j].Location
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Line < b.Line
+	})
+	return result
+}
+
+// lessonCollector gathers every lesson in a tutorial.
+type lessonCollector struct {
+	lessons []*model.LessonTut
+}
+
+func (v *lessonCollector) VisitBlockTut(b *model.BlockTut) {}
+
+func (v *lessonCollector) VisitLessonTut(l *model.LessonTut) {
+	v.lessons = append(v.lessons, l)
+}
+
+func (v *lessonCollector) VisitCourse(c *model.Course) {
+	for _, x := range c.Children() {
+		x.Accept(v)
+	}
+}
+
+func (v *lessonCollector) VisitTopCourse(t *model.TopCourse) {
+	for _, x := range t.Children() {
+		x.Accept(v)
+	}
+}
+
+// fencedBlocks returns the lesson's blocks that came from fences,
+// dropping any holding only the prose at the end of the file.
+func fencedBlocks(l *model.LessonTut) []*model.BlockTut {
+	result := []*model.BlockTut{}
+	for _, b := range l.Blocks() {
+		if b.Location().Known() {
+			result = append(result, b)
+		}
+	}
+	return result
+}
+
+// firstLine returns the first line of a block's code, for a snippet.
+func firstLine(b *model.BlockTut) string {
+	return util.SampleString(strings.SplitN(b.Code().String(), "\n", 2)[0], 60)
+}
+
+func unlabelledBlocks(l *model.LessonTut) []base.Diagnostic {
+	blocks := fencedBlocks(l)
+	labelled := false
+	for _, b := range blocks {
+		if len(b.Labels()) > 0 {
+			labelled = true
+		}
+	}
+	result := []base.Diagnostic{}
+	if !labelled {
+		return result
+	}
+	for _, b := range blocks {
+		if len(b.Labels()) == 0 {
+			result = append(result, base.Diagnostic{
+				Kind:     base.UnlabelledBlock,
+				Location: b.Location(),
+				Snippet:  firstLine(b),
+				Message:  "block has no labels, unlike the others in its file",
+			})
+		}
+	}
+	return result
+}
+
+func loneLabels(lessons []*model.LessonTut) []base.Diagnostic {
+	count := map[base.Label]int{}
+	for _, l := range lessons {
+		for _, b := range fencedBlocks(l) {
+			for _, label := range b.Labels() {
+				count[label]++
+			}
+		}
+	}
+	result := []base.Diagnostic{}
+	for _, l := range lessons {
+		for _, b := range fencedBlocks(l) {
+			for i, label := range b.Labels() {
+				if i == 0 || label.IsDirective() || count[label] > 1 {
+					continue
+				}
+				result = append(result, base.Diagnostic{
+					Kind:     base.LoneLabel,
+					Location: b.LabelLocation(),
+					Snippet:  "@" + string(label),
+					Message:  "label used only once; is it a typo?",
+				})
+			}
+		}
+	}
+	return result
+}
+
+func unknownAttrs(b *model.BlockTut) []base.Diagnostic {
+	result := []base.Diagnostic{}
+	for _, k := range b.Attributes().Keys() {
+		if base.IsKnownAttr(k) {
+			continue
+		}
+		result = append(result, base.Diagnostic{
+			Kind:     base.UnknownAttr,
+			Location: b.LabelLocation(),
+			Snippet:  k + "=",
+			Message:  "unknown attribute; is it a typo?",
+		})
+	}
+	return result
+}
+
+// codeLine returns the location of the given line, counting from 0,
+// of a block's code.
+func codeLine(b *model.BlockTut, n int) base.Location {
+	l := b.Location()
+	l.Line += n + 1
+	l.Column, l.EndLine = 1, l.Line
+	return l
+}
+
+func badSpace(b *model.BlockTut) []base.Diagnostic {
+	result := []base.Diagnostic{}
+	for i, line := range strings.Split(strings.TrimSuffix(b.Code().String(), "\n"), "\n") {
+		if strings.HasSuffix(line, "\r") {
+			result = append(result, base.Diagnostic{
+				Kind:     base.CarriageReturn,
+				Location: codeLine(b, i),
+				Snippet:  line,
+				Message:  "line ends with a carriage return",
+			})
+		} else if strings.TrimRight(line, " \t") != line {
+			result = append(result, base.Diagnostic{
+				Kind:     base.TrailingSpace,
+				Location: codeLine(b, i),
+				Snippet:  line,
+				Message:  "line ends with whitespace",
+			})
+		}
+	}
+	return result
+}
+
+// bashError matches the line number and message of a bash -n error.
+var bashError = regexp.MustCompile(`line ([0-9]+): (.*)`)
+
+// shellSyntax checks the syntax of a block as its script would be run.
+// Blocks in other languages, wrapped for bash, get checked only for
+// the wrapping.  Errors in a block whose script is its code can be
+// placed on the right line; others are placed on the fence.
+func shellSyntax(b *model.BlockTut) []base.Diagnostic {
+	p := program.NewBlockPgmFromBlockTut(b)
+	if !p.Runnable() {
+		return nil
+	}
+	script := p.Script()
+	cmd := exec.Command("bash", "-n")
+	cmd.Stdin = strings.NewReader(script)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if cmd.Run() == nil {
+		return nil
+	}
+	loc := b.Location()
+	msg := strings.TrimSpace(stderr.String())
+	snippet := firstLine(b)
+	if m := bashError.FindStringSubmatch(msg); m != nil {
+		msg = m[2]
+		if n, err := strconv.Atoi(m[1]); err == nil && script == b.Code().String() {
+			loc = codeLine(b, n-1)
+			snippet = util.SampleString(lineOf(script, n), 60)
+		}
+	}
+	return []base.Diagnostic{{
+		Kind:     base.ShellSyntax,
+		Location: loc,
+		Snippet:  snippet,
+		Message:  fmt.Sprintf("bash: %s", msg),
+	}}
+}
+
+// lineOf returns line n, counting from 1, of s.
+func lineOf(s string, n int) string {
+	lines := strings.Split(s, "\n")
+	if n < 1 || n > len(lines) {
+		return ""
+	}
+	return lines[n-1]
+}
@@ -0,0 +1,72 @@
+package lint
+
+import (
+	"testing"
+
+	"github.com/monopole/mdrip/base"
+	"github.com/monopole/mdrip/lexer"
+	"github.com/monopole/mdrip/model"
+)
+
+func lesson(path base.FilePath, contents string) *model.LessonTut {
+	blocks, diags := lexer.ParseFile(path, contents)
+	l := model.NewLessonTutFromBlockParsed(path, blocks)
+	l.SetDiagnostics(diags)
+	return l
+}
+
+func TestLint(t *testing.T) {
+	a := lesson("a.md", "# A\n"+ // 1
+		"<!-- @one @lesson1 -->\n"+ // 2
+		"```\necho hi  \nif true; then\n  ls\nfi\n```\n"+ // 3-8
+		"```\necho unlabelled\r\n```\n"+ // 9-11
+		"<!-- @two @lesson1 @lesson2 -->\n"+ // 12
+		"```\necho fine\necho (\n```\n"+ // 13-16
+		"<!-- @three -->\n"+ // 17
+		"prose\n"+ // 18
+		"<!-- @four @lesson1 @sleep -->\n"+ // 19
+		"```python\nprint(1)\n```\n"+ // 20-22
+		"<!-- oops\n") // 23
+	b := lesson("b.md", "```\nls\n```\n"+
+		"<!-- @five @lesson3 -->\n```\n$(\n```\n"+
+		"<!-- @six skipif=true dir=/tmp -->\n```\nls\n```\n")
+	tut := model.NewTopCourse("top", "top", []model.Tutorial{a, b})
+	want := []struct {
+		file base.FilePath
+		line int
+		kind base.DiagnosticKind
+	}{
+		{"a.md", 4, base.TrailingSpace},
+		{"a.md", 9, base.UnlabelledBlock},
+		{"a.md", 10, base.CarriageReturn},
+		{"a.md", 12, base.LoneLabel},
+		{"a.md", 15, base.ShellSyntax},
+		{"a.md", 17, base.LabelsWithoutCode},
+		{"a.md", 23, base.UnclosedComment},
+		{"b.md", 1, base.UnlabelledBlock},
+		{"b.md", 4, base.LoneLabel},
+		{"b.md", 7, base.ShellSyntax},
+		{"b.md", 8, base.UnknownAttr},
+	}
+	got := Lint(tut)
+	if len(got) != len(want) {
+		t.Fatalf("got %d problems, want %d: %v", len(got), len(want), got)
+	}
+	for i, d := range got {
+		w := want[i]
+		if d.Location.File != w.file || d.Location.Line != w.line || d.Kind != w.kind {
+			t.Errorf("problem %d: got %v (%s), want %s at %s:%d",
+				i, d, d.Kind, w.kind, w.file, w.line)
+		}
+	}
+	if s := got[3].String(); s != `a.md:12:6: label used only once; is it a typo?: "@lesson2"` {
+		t.Errorf("got %q", s)
+	}
+}
+
+func TestLintClean(t *testing.T) {
+	l := lesson("c.md", "<!-- @one @all -->\n```\nls\n```\n<!-- @two @all -->\n```console\n$ date\n...\n```\n")
+	if got := Lint(l); len(got) != 0 {
+		t.Errorf("expected no problems, got %v", got)
+	}
+}
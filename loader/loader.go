@@ -90,11 +90,16 @@ func scanFile(n base.FilePath) (model.Tutorial, error) {
 	if err != nil {
 		return BadLoad(n), err
 	}
-	parsed := lexer.Parse(contents)
+	parsed, diags := lexer.ParseFile(n, contents)
+	for _, d := range diags {
+		glog.Error(d)
+	}
 	if len(parsed) < 1 {
 		return BadLoad(n), errors.New("no content in " + string(n))
 	}
-	return model.NewLessonTutFromBlockParsed(n, parsed), nil
+	l := model.NewLessonTutFromBlockParsed(n, parsed)
+	l.SetDiagnostics(diags)
+	return l, nil
 }
 
 // A tutorial complaining about its data source.
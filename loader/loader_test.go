@@ -96,3 +96,30 @@ func xTestLoadTutorialFromGitHub(t *testing.T) {
 	printer := model.NewTutorialTxtPrinter(os.Stdout)
 	tut.Accept(printer)
 }
+
+func TestScanFileKeepsGoingPastProblems(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "loader-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path := base.FilePath(tmpDir + "/foo.md")
+	contents := "<!-- @beans\n```\necho beans\n```\n" +
+		"<!-- @rice -->\n```\necho rice\n```\n" +
+		"<!-- @kale! -->\n```\necho kale\n```\n"
+	if err := ioutil.WriteFile(string(path), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tut, err := scanFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	l := tut.(*model.LessonTut)
+	if n := len(l.Blocks()); n != 3 {
+		t.Errorf("got %d blocks, want 3", n)
+	}
+	d := l.Diagnostics()
+	if len(d) != 2 || d[0].Kind != base.UnclosedLabels || d[1].Kind != base.BadLabelsClose {
+		t.Errorf("unexpected diagnostics %v", d)
+	}
+}
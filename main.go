@@ -2,14 +2,17 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/golang/glog"
 	"github.com/monopole/mdrip/config"
+	"github.com/monopole/mdrip/lint"
 	"github.com/monopole/mdrip/loader"
 	"github.com/monopole/mdrip/program"
 	"github.com/monopole/mdrip/subshell"
 	"github.com/monopole/mdrip/tmux"
+	"github.com/monopole/mdrip/updater"
 	"github.com/monopole/mdrip/webserver"
 )
 
@@ -34,24 +37,84 @@ func trueMain(c *config.Config) error {
 		}
 		s.Serve(c.HostAndPort())
 	case config.ModeTest:
-		t, err := loader.NewLoader(c.DataSource()).Load()
+		p, err := loadProgram(c)
+		if err != nil {
+			return err
+		}
+		s, err := newSubshell(c, p)
 		if err != nil {
 			return err
 		}
-		p := program.NewProgramFromTutorial(c.Label(), t)
-		s := subshell.NewSubshell(c.BlockTimeOut(), p)
-		if r := s.Run(); r.Problem() != nil {
-			r.Print(c.Label())
-			if !c.IgnoreTestFailure() {
+		s.SetKeepGoing(c.KeepGoing()).SetParallel(c.Parallel())
+		for _, spec := range c.Reports() {
+			if !spec.Format.Streaming() {
+				continue
+			}
+			w, err := openReport(spec)
+			if err != nil {
+				return err
+			}
+			defer w.Close()
+			if spec.Format == config.ReportTap {
+				s.AddListener(subshell.NewTapListener(w))
+			} else {
+				s.AddListener(subshell.NewJsonLinesListener(w))
+			}
+		}
+		r := s.Run().SetCommand(os.Args)
+		r.Print(os.Stderr)
+		for _, spec := range c.Reports() {
+			if spec.Format.Streaming() {
+				continue
+			}
+			if err := writeReport(spec, r); err != nil {
+				return err
+			}
+		}
+		if r.Problem() != nil && !c.IgnoreTestFailure() {
+			glog.Fatal(r.Problem())
+		}
+	case config.ModeUpdate:
+		p, err := loadProgram(c)
+		if err != nil {
+			return err
+		}
+		s, err := newSubshell(c, p)
+		if err != nil {
+			return err
+		}
+		r := s.Run()
+		r.Print(os.Stderr)
+		changed, err := updater.Update(r)
+		for _, f := range changed {
+			fmt.Fprintf(os.Stderr, "Updated %s\n", f)
+		}
+		if err != nil {
+			return err
+		}
+		for _, b := range r.Failures() {
+			if !b.Completed() {
 				glog.Fatal(r.Problem())
 			}
 		}
-	default:
+	case config.ModeLint:
 		t, err := loader.NewLoader(c.DataSource()).Load()
 		if err != nil {
 			return err
 		}
-		p := program.NewProgramFromTutorial(c.Label(), t)
+		problems := lint.Lint(t)
+		for _, d := range problems {
+			fmt.Println(d)
+		}
+		if len(problems) > 0 {
+			fmt.Fprintf(os.Stderr, "%d problems found\n", len(problems))
+			os.Exit(1)
+		}
+	default:
+		p, err := loadProgram(c)
+		if err != nil {
+			return err
+		}
 		if c.Preambled() > 0 {
 			p.PrintPreambled(os.Stdout, c.Preambled())
 		} else {
@@ -61,6 +124,75 @@ func trueMain(c *config.Config) error {
 	return nil
 }
 
+// loadProgram extracts from the markdown the blocks selected by
+// --label, or by --target, then cuts them down to those from --from
+// to --to.
+func loadProgram(c *config.Config) (*program.Program, error) {
+	t, err := loader.NewLoader(c.DataSource()).Load()
+	if err != nil {
+		return nil, err
+	}
+	p := program.NewProgramFromTutorial(c.Label(), t)
+	if names := c.Target(); len(names) > 0 {
+		if p, err = p.Target(names); err != nil {
+			return nil, err
+		}
+	}
+	if len(c.From()) > 0 || len(c.To()) > 0 {
+		return p.Slice(c.From(), c.To())
+	}
+	return p, nil
+}
+
+// newSubshell returns a subshell to run the program with the time
+// limits and environment given by flags.  Settings from --envFile
+// come before those from --env, so the latter win.
+func newSubshell(c *config.Config, p *program.Program) (*subshell.Subshell, error) {
+	s := subshell.NewSubshell(c.BlockTimeOut(), p).SetRunTimeout(c.RunTimeOut())
+	for _, f := range c.EnvFiles() {
+		env, err := subshell.ReadEnvFile(f)
+		if err != nil {
+			return nil, err
+		}
+		s.AddEnv(env...)
+	}
+	s.AddEnv(c.Env()...)
+	if c.CleanEnv() {
+		s.SetCleanEnv(c.KeepEnv())
+	}
+	return s, nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// openReport opens the file named by the report spec.
+func openReport(spec config.ReportSpec) (io.WriteCloser, error) {
+	if spec.Path == config.StdOutPath {
+		return nopCloser{os.Stdout}, nil
+	}
+	return os.Create(spec.Path)
+}
+
+// writeReport writes the run report to a file in the requested format.
+func writeReport(spec config.ReportSpec, r *subshell.RunReport) error {
+	w, err := openReport(spec)
+	if err != nil {
+		return err
+	}
+	switch spec.Format {
+	case config.ReportJUnit:
+		err = subshell.WriteJUnit(w, r)
+	}
+	if cErr := w.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
+
 func main() {
 	c, err := config.GetConfig()
 	if err != nil {
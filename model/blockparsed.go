@@ -2,10 +2,18 @@ package model
 
 import "github.com/monopole/mdrip/base"
 
-// BlockParsed groups a BlockBase with labels.
+// BlockParsed groups a BlockBase with labels, the language named by
+// the block's fence, and the output the block is expected to
+// produce, if known.
 type BlockParsed struct {
 	base.BlockBase
-	labels []base.Label
+	labels   []base.Label
+	args     map[base.Label]string // e.g. "2" for label "exit" in @exit=2
+	attrs    base.Attributes       // e.g. dir=/tmp/x
+	language string                // e.g. "python", or empty if unnamed
+	expected *base.ExpectedOutput
+	location base.Location // Of the fence, from opening to closing.
+	labelLoc base.Location // Of the labels, if any.
 }
 
 func NewProseOnlyBlock(p base.MdProse) *BlockParsed {
@@ -13,10 +21,55 @@ func NewProseOnlyBlock(p base.MdProse) *BlockParsed {
 }
 
 func NewBlockParsed(labels []base.Label, p base.MdProse, c base.OpaqueCode) *BlockParsed {
-	return &BlockParsed{base.NewBlockBase(p, c), labels}
+	return &BlockParsed{base.NewBlockBase(p, c), labels, nil, nil, "", nil,
+		base.Location{}, base.Location{}}
 }
 
 func (x *BlockParsed) Labels() []base.Label { return x.labels }
+
+// LabelArg returns the value given to a label, e.g. "2" for "exit"
+// if the block was labelled with @exit=2.
+func (x *BlockParsed) LabelArg(l base.Label) (string, bool) {
+	v, ok := x.args[l]
+	return v, ok
+}
+func (x *BlockParsed) SetLabelArgs(args map[base.Label]string) {
+	x.args = args
+}
+
+// Attributes returns the key=value pairs given with the block's
+// labels, e.g. dir=/tmp/x.  The result may be nil, which is empty.
+func (x *BlockParsed) Attributes() base.Attributes { return x.attrs }
+func (x *BlockParsed) SetAttributes(a base.Attributes) {
+	x.attrs = a
+}
+
+// Language is the language named by the block's fence, e.g. "go" for
+// a block opened with "```go", or empty if the fence named none.
+func (x *BlockParsed) Language() string { return x.language }
+func (x *BlockParsed) SetLanguage(l string) {
+	x.language = l
+}
+
+// Expected returns the block's expected output, or nil.
+func (x *BlockParsed) Expected() *base.ExpectedOutput { return x.expected }
+func (x *BlockParsed) SetExpected(e *base.ExpectedOutput) {
+	x.expected = e
+}
+
+// Location is where the block's fence is, from its opening line to
+// its closing line.
+func (x *BlockParsed) Location() base.Location { return x.location }
+func (x *BlockParsed) SetLocation(l base.Location) {
+	x.location = l
+}
+
+// LabelLocation is where the block's labels are, if it has any.
+func (x *BlockParsed) LabelLocation() base.Location { return x.labelLoc }
+func (x *BlockParsed) SetLabelLocation(l base.Location) {
+	x.labelLoc = l
+}
+
 func (x *BlockParsed) HasLabel(label base.Label) bool {
 	for _, l := range x.labels {
 		if l == label {
@@ -19,19 +19,19 @@ var bb = base.NewBlockBase(
 
 var bpTests = []bpTest{
 	{"empty",
-		BlockParsed{bb, []base.Label{}},
+		BlockParsed{BlockBase: bb, labels: []base.Label{}},
 		base.WildCardLabel,
 		false},
 	{"test1",
-		BlockParsed{bb, []base.Label{base.WildCardLabel, base.SleepLabel}},
+		BlockParsed{BlockBase: bb, labels: []base.Label{base.WildCardLabel, base.SleepLabel}},
 		base.WildCardLabel,
 		true},
 	{"test2",
-		BlockParsed{bb, []base.Label{base.SleepLabel, base.WildCardLabel}},
+		BlockParsed{BlockBase: bb, labels: []base.Label{base.SleepLabel, base.WildCardLabel}},
 		base.WildCardLabel,
 		true},
 	{"test2",
-		BlockParsed{bb, []base.Label{base.SleepLabel, base.SleepLabel}},
+		BlockParsed{BlockBase: bb, labels: []base.Label{base.SleepLabel, base.SleepLabel}},
 		base.WildCardLabel,
 		false},
 }
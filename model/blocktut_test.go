@@ -14,19 +14,19 @@ type btTest struct {
 
 var btTests = []btTest{
 	{"empty",
-		BlockParsed{bb, []base.Label{}},
+		BlockParsed{BlockBase: bb, labels: []base.Label{}},
 		AnonBlockName},
 	{"anylabel",
-		BlockParsed{bb, []base.Label{base.WildCardLabel}},
+		BlockParsed{BlockBase: bb, labels: []base.Label{base.WildCardLabel}},
 		AnonBlockName},
 	{"sleeplabel",
-		BlockParsed{bb, []base.Label{base.SleepLabel, base.WildCardLabel}},
+		BlockParsed{BlockBase: bb, labels: []base.Label{base.SleepLabel, base.WildCardLabel}},
 		"sleep"},
 	{"wildFirst",
-		BlockParsed{bb, []base.Label{base.WildCardLabel, base.Label("hoser"), base.SleepLabel}},
+		BlockParsed{BlockBase: bb, labels: []base.Label{base.WildCardLabel, base.Label("hoser"), base.SleepLabel}},
 		"hoser"},
 	{"xFirst",
-		BlockParsed{bb, []base.Label{base.Label("shazam"), base.WildCardLabel, base.SleepLabel}},
+		BlockParsed{BlockBase: bb, labels: []base.Label{base.Label("shazam"), base.WildCardLabel, base.SleepLabel}},
 		"shazam"},
 }
 
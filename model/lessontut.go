@@ -11,10 +11,12 @@ import (
 type LessonTut struct {
 	path   base.FilePath
 	blocks []*BlockTut
+	// Problems found parsing the file.
+	diagnostics []base.Diagnostic
 }
 
 func NewLessonTut(p base.FilePath, blocks []*BlockTut) *LessonTut {
-	return &LessonTut{p, blocks}
+	return &LessonTut{p, blocks, nil}
 }
 
 func NewLessonTutFromBlockParsed(p base.FilePath, blocks []*BlockParsed) *LessonTut {
@@ -28,6 +30,12 @@ func NewLessonTutFromBlockParsed(p base.FilePath, blocks []*BlockParsed) *Lesson
 func (l *LessonTut) Accept(v TutVisitor) { v.VisitLessonTut(l) }
 func (l *LessonTut) Name() string        { return util.DropLeadingNumbers(l.path.Base()) }
 func (l *LessonTut) Path() base.FilePath { return l.path }
+
+// Diagnostics describes problems found parsing the lesson's file.
+func (l *LessonTut) Diagnostics() []base.Diagnostic { return l.diagnostics }
+func (l *LessonTut) SetDiagnostics(d []base.Diagnostic) {
+	l.diagnostics = d
+}
 func (l *LessonTut) Children() []Tutorial {
 	result := []Tutorial{}
 	for _, b := range l.blocks {
@@ -16,9 +16,9 @@ type ltTest struct {
 }
 
 var array1 = []*BlockParsed{
-	{bb, []base.Label{}},
-	{bb, []base.Label{base.WildCardLabel}},
-	{bb, []base.Label{base.SleepLabel, base.WildCardLabel}},
+	{BlockBase: bb, labels: []base.Label{}},
+	{BlockBase: bb, labels: []base.Label{base.WildCardLabel}},
+	{BlockBase: bb, labels: []base.Label{base.SleepLabel, base.WildCardLabel}},
 }
 
 var ltTests = []ltTest{
@@ -2,11 +2,17 @@ package program
 
 import (
 	"fmt"
+	"html/template"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
 	"github.com/monopole/mdrip/base"
 	"github.com/monopole/mdrip/model"
+	"github.com/monopole/mdrip/util"
 	"github.com/russross/blackfriday"
-	"html/template"
-	"io"
 )
 
 // BlockPgm is input to execution.
@@ -16,15 +22,50 @@ type BlockPgm struct {
 	name string
 	// Should a sleep be added?
 	shouldAddSleep bool
+	// What the block should write to stdout, if known.
+	expected *base.ExpectedOutput
+	// The exit status the block should have; see ExitAnyFailure.
+	expectedExit int
+	// Should the block run after the others, no matter what?
+	isCleanup bool
+	// Does the block set up the environment for those after it?
+	isSetup bool
+	// How long the block may run; zero means use the default.
+	timeout time.Duration
+	// The language the code is in; see InterpreterFor.
+	language string
+	// Where the block is in its markdown file, if known.
+	location base.Location
+	// The directory to run the block in; empty means wherever the
+	// previous block left the shell.
+	dir string
+	// Variables to set for the block, each as NAME=value.
+	env []string
+	// A command that, if it succeeds, means the block is skipped.
+	skipIf string
+	// The names of the blocks this one needs to run first.
+	needs []string
+	// The session, i.e. shell, the block runs in; empty means the
+	// default one.
+	session string
+	// What to wait for once the block's code has run, how long to
+	// wait, and how often to check.
+	readiness    []Readiness
+	waitTimeout  time.Duration
+	waitInterval time.Duration
 	base.BlockBase
 }
 
+// ExitAnyFailure as an expected exit status means any non-zero status.
+const ExitAnyFailure = -1
+
 func NewEmptyBlockPgm() *BlockPgm {
 	return NewBlockPgm("")
 }
 
 func NewBlockPgm(code string) *BlockPgm {
-	return &BlockPgm{"noNameBlock", false,
+	return &BlockPgm{"noNameBlock", false, nil, 0, false, false, 0, "", base.Location{},
+		"", nil, "", nil, "", nil, DefaultWaitTimeout, DefaultWaitInterval,
 		base.NewBlockBase(base.NoProse(), base.OpaqueCode(code))}
 }
 
@@ -32,22 +73,329 @@ func NewBlockPgmFromBlockTut(b *model.BlockTut) *BlockPgm {
 	return &BlockPgm{
 		b.Name(),
 		b.HasLabel(base.SleepLabel),
+		blockExpected(b),
+		expectedExit(b),
+		b.HasLabel(base.CleanupLabel),
+		b.HasLabel(base.SetupLabel),
+		blockTimeout(b),
+		b.Language(),
+		b.Location(),
+		blockDir(b),
+		blockEnv(b),
+		blockSkipIf(b),
+		blockNeeds(b),
+		blockSession(b),
+		readinessOf(b),
+		waitDuration(b, base.WaitTimeoutAttr, DefaultWaitTimeout),
+		waitDuration(b, base.WaitIntervalAttr, DefaultWaitInterval),
 		base.NewBlockBase(b.Prose(), b.Code())}
 }
 
+// blockExpected returns the output a block should write: that held
+// by the output fence following it, if any, else that shown in a
+// session transcript.
+func blockExpected(b *model.BlockTut) *base.ExpectedOutput {
+	if e := b.Expected(); e != nil || !isSession(b.Language()) {
+		return e
+	}
+	return sessionExpected(string(b.Code()))
+}
+
+// expectedExit reads the expected exit status from @fails or @exit=n.
+func expectedExit(b *model.BlockTut) int {
+	if v, ok := b.LabelArg(base.ExitLabel); ok {
+		n, err := strconv.Atoi(v)
+		if err == nil && n >= 0 && n < 256 {
+			return n
+		}
+		glog.Warningf("block %s: bad exit status %q, expecting any failure", b.Name(), v)
+		return ExitAnyFailure
+	}
+	if b.HasLabel(base.FailsLabel) {
+		return ExitAnyFailure
+	}
+	return 0
+}
+
+// blockTimeout reads the time a block may run from timeout=d, or
+// failing that from @timeout=d.
+func blockTimeout(b *model.BlockTut) time.Duration {
+	d, ok, err := b.Attributes().Duration(base.TimeoutAttr)
+	if err != nil {
+		glog.Warningf("block %s: %v, using the default", b.Name(), err)
+		return 0
+	}
+	if ok {
+		return d
+	}
+	v, ok := b.LabelArg(base.TimeoutLabel)
+	if !ok {
+		return 0
+	}
+	d, err = time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		glog.Warningf("block %s: bad timeout %q, using the default", b.Name(), v)
+		return 0
+	}
+	return d
+}
+
+// blockDir reads the directory a block runs in from dir=path.
+func blockDir(b *model.BlockTut) string {
+	v, _ := b.Attributes().Get(base.DirAttr)
+	return v
+}
+
+// blockEnv reads the variables a block sets from env=NAME=value,
+// dropping any that aren't of that form.
+func blockEnv(b *model.BlockTut) []string {
+	var result []string
+	for _, v := range b.Attributes().All(base.EnvAttr) {
+		if _, _, ok := util.SplitEnv(v); !ok {
+			glog.Warningf("block %s: bad env %q, expecting NAME=value", b.Name(), v)
+			continue
+		}
+		result = append(result, v)
+	}
+	return result
+}
+
+// blockSkipIf reads the command deciding whether to skip a block
+// from skip-if=command.
+func blockSkipIf(b *model.BlockTut) string {
+	v, _ := b.Attributes().Get(base.SkipIfAttr)
+	return v
+}
+
+// blockNeeds reads the names of the blocks a block needs from
+// needs=a,b, which may be given more than once.
+func blockNeeds(b *model.BlockTut) []string {
+	var result []string
+	for _, v := range b.Attributes().All(base.NeedsAttr) {
+		for _, n := range strings.Split(v, ",") {
+			if n = strings.TrimSpace(n); n != "" {
+				result = append(result, n)
+			}
+		}
+	}
+	return result
+}
+
+// blockSession reads the session a block runs in from session=name.
+func blockSession(b *model.BlockTut) string {
+	v, _ := b.Attributes().Get(base.SessionAttr)
+	return v
+}
+
 func (x *BlockPgm) Name() string { return x.name }
+
+// ExpectedExit is the exit status the block should have, or
+// ExitAnyFailure.
+func (x *BlockPgm) ExpectedExit() int { return x.expectedExit }
+
+func (x *BlockPgm) SetExpectedExit(n int) *BlockPgm {
+	x.expectedExit = n
+	return x
+}
+
+// Language is the language of the block's code, e.g. "python", or
+// empty for bash.
+func (x *BlockPgm) Language() string { return x.language }
+
+func (x *BlockPgm) SetLanguage(l string) *BlockPgm {
+	x.language = l
+	return x
+}
+
+// Runnable is true if there's an interpreter for the block's
+// language.
+func (x *BlockPgm) Runnable() bool {
+	_, ok := InterpreterFor(x.language)
+	return ok
+}
+
+// Script returns bash that runs the block's code, or nothing if the
+// block isn't Runnable.
+func (x *BlockPgm) Script() string {
+	i, ok := InterpreterFor(x.language)
+	if !ok {
+		return ""
+	}
+	return i(string(x.Code()))
+}
+
+// Commands returns the block's code as a user would type it: for a
+// session transcript, just the commands, without prompts or output.
+func (x *BlockPgm) Commands() string {
+	if isSession(x.language) {
+		return sessionCode(string(x.Code()))
+	}
+	return string(x.Code())
+}
+
+// Timeout is how long the block may run, or zero if the block
+// doesn't say.
+func (x *BlockPgm) Timeout() time.Duration { return x.timeout }
+
+func (x *BlockPgm) SetTimeout(d time.Duration) *BlockPgm {
+	x.timeout = d
+	return x
+}
+
+// IsCleanup is true if the block should run after the rest of its
+// lesson, even if the rest failed.
+func (x *BlockPgm) IsCleanup() bool { return x.isCleanup }
+
+func (x *BlockPgm) SetCleanup(c bool) *BlockPgm {
+	x.isCleanup = c
+	return x
+}
+
+// IsSetup is true if the block sets up the environment for the
+// blocks after it, so must run even if the run starts after it.
+func (x *BlockPgm) IsSetup() bool { return x.isSetup }
+
+func (x *BlockPgm) SetSetup(s bool) *BlockPgm {
+	x.isSetup = s
+	return x
+}
+
+// Location is where the block's fence is in its markdown file.
+func (x *BlockPgm) Location() base.Location { return x.location }
+
+func (x *BlockPgm) SetLocation(l base.Location) *BlockPgm {
+	x.location = l
+	return x
+}
+
+// Dir is the directory the block should run in, or empty if it
+// runs wherever the previous block left the shell.
+func (x *BlockPgm) Dir() string { return x.dir }
+
+func (x *BlockPgm) SetDir(d string) *BlockPgm {
+	x.dir = d
+	return x
+}
+
+// Env lists the variables to set while the block runs, each as
+// NAME=value.
+func (x *BlockPgm) Env() []string { return x.env }
+
+func (x *BlockPgm) SetEnv(env []string) *BlockPgm {
+	x.env = env
+	return x
+}
+
+// SkipIf is a command to run before the block; if it succeeds, the
+// block is skipped.  Empty means the block always runs.
+func (x *BlockPgm) SkipIf() string { return x.skipIf }
+
+func (x *BlockPgm) SetSkipIf(c string) *BlockPgm {
+	x.skipIf = c
+	return x
+}
+
+// Needs lists the names of the blocks that must run before this one;
+// see Program.Target.
+func (x *BlockPgm) Needs() []string { return x.needs }
+
+func (x *BlockPgm) SetNeeds(names []string) *BlockPgm {
+	x.needs = names
+	return x
+}
+
+// Session names the shell the block runs in, alongside those of
+// other sessions, each with its own environment and working
+// directory.  Empty means the default session.
+func (x *BlockPgm) Session() string { return x.session }
+
+func (x *BlockPgm) SetSession(s string) *BlockPgm {
+	x.session = s
+	return x
+}
+
+// Readiness lists the conditions to wait for once the block's code
+// has run.
+func (x *BlockPgm) Readiness() []Readiness { return x.readiness }
+
+// SetReadiness sets the conditions to wait for, how long to wait
+// for each, and how often to check.
+func (x *BlockPgm) SetReadiness(
+	r []Readiness, timeout, interval time.Duration) *BlockPgm {
+	x.readiness, x.waitTimeout, x.waitInterval = r, timeout, interval
+	return x
+}
+
+// WaitTime is the longest the block may spend waiting for its
+// readiness conditions, over and above the time its code takes.
+func (x *BlockPgm) WaitTime() time.Duration {
+	return time.Duration(len(x.readiness)) * x.waitTimeout
+}
+
+// WaitScript returns bash that waits for each of the block's
+// readiness conditions in turn, or nothing if it has none.
+func (x *BlockPgm) WaitScript() string {
+	var b strings.Builder
+	for _, r := range x.readiness {
+		b.WriteString(waitLoop(r, x.waitTimeout, x.waitInterval))
+	}
+	return b.String()
+}
+
+// Body returns Script followed by WaitScript.
+func (x *BlockPgm) Body() string {
+	return x.thenWait(x.Script())
+}
+
+// thenWait returns the given code followed by WaitScript.
+func (x *BlockPgm) thenWait(code string) string {
+	w := x.WaitScript()
+	if w == "" {
+		return code
+	}
+	return strings.TrimSuffix(code, "\n") + "\n" + w
+}
+
+// Confined is true if the block must run in a subshell of its own,
+// so that changing directory or setting variables for it doesn't
+// affect later blocks.
+func (x *BlockPgm) Confined() bool {
+	return x.dir != "" || len(x.env) > 0
+}
+
+// Expected returns the block's expected output, or nil.
+func (x *BlockPgm) Expected() *base.ExpectedOutput { return x.expected }
+
+func (x *BlockPgm) SetExpected(e *base.ExpectedOutput) *BlockPgm {
+	x.expected = e
+	return x
+}
 func (x *BlockPgm) HtmlProse() template.HTML {
 	return template.HTML(string(blackfriday.MarkdownCommon(x.Prose())))
 }
 
 func (x *BlockPgm) Print(
 	w io.Writer, prefix string, n int, label base.Label, fileName base.FilePath) {
+	where := string(fileName)
+	if x.location.Known() {
+		where = x.location.InFile(fileName).String()
+	}
 	fmt.Fprintf(w, "echo \"%s @%s (block #%d in %s) of %s\"\n\n",
-		prefix, x.Name(), n, label, fileName)
-	fmt.Fprint(w, x.Code())
-	// Add a brief sleep at the end.
-	// This hack gives servers placed in the background time to start, assuming
-	// they can do so in the time added!  Yeah, bad.
+		prefix, x.Name(), n, label, where)
+	if x.session != "" {
+		fmt.Fprintf(w, "# In test mode, runs in session %q.\n", x.session)
+	}
+	if !x.Runnable() {
+		fmt.Fprintf(w, "# Skipped; no interpreter for language %q.\n", x.language)
+		return
+	}
+	fmt.Fprint(w, x.thenWait(x.Commands()))
+	if len(x.readiness) > 0 {
+		return
+	}
+	// Give servers placed in the background time to start, assuming
+	// they can do so in the time added.  Readiness conditions, e.g.
+	// wait-port=8080, are better.
 	if x.shouldAddSleep {
 		fmt.Fprint(w, "sleep 3s # Added by mdrip\n")
 	}
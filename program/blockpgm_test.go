@@ -1,7 +1,13 @@
 package program
 
 import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/monopole/mdrip/base"
 	"github.com/monopole/mdrip/model"
@@ -32,3 +38,376 @@ func TestBlockPgm(t *testing.T) {
 			"          got \"%s\"", expected, got)
 	}
 }
+
+func TestBlockPgmTimeout(t *testing.T) {
+	for arg, want := range map[string]time.Duration{
+		"5m": 5 * time.Minute, "1m30s": 90 * time.Second, "bogus": 0, "-1s": 0} {
+		bParsed := model.NewBlockParsed(
+			[]base.Label{"slow", base.TimeoutLabel}, base.NoProse(), base.OpaqueCode("bar"))
+		bParsed.SetLabelArgs(map[base.Label]string{base.TimeoutLabel: arg})
+		if got := NewBlockPgmFromBlockTut(model.NewBlockTut(bParsed)).Timeout(); got != want {
+			t.Errorf("@timeout=%s: got %v, want %v", arg, got, want)
+		}
+	}
+}
+
+func TestBlockPgmScript(t *testing.T) {
+	b := NewBlockPgm("$ echo hi\nhi\n$ ls\n").SetLanguage("console")
+	if got, want := b.Script(), "echo hi\nls\n"; got != want {
+		t.Errorf("console: got %q, want %q", got, want)
+	}
+	b.SetLanguage("Python")
+	if !b.Runnable() || !strings.Contains(b.Script(), `python3 "$__mdrip_dir/block.py"`) {
+		t.Errorf("python: got %q", b.Script())
+	}
+	var buf strings.Builder
+	b.Print(&buf, "#", 1, base.WildCardLabel, "foo.md")
+	if strings.Contains(buf.String(), "__mdrip_dir") || !strings.HasSuffix(buf.String(), "\n$ ls\n") {
+		t.Errorf("python: expected print to show just the code, got %q", buf.String())
+	}
+	b.SetLanguage("yaml")
+	if b.Runnable() || b.Script() != "" {
+		t.Errorf("yaml: expected no interpreter, got %q", b.Script())
+	}
+	RegisterInterpreter("yaml", func(code string) string { return "cat <<EOF\n" + code + "EOF\n" })
+	defer delete(interpreters, "yaml")
+	if !b.Runnable() {
+		t.Errorf("yaml: expected an interpreter once registered")
+	}
+}
+
+func TestHereDocEnd(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"print('hi')\n", "MDRIP_BLOCK_EOF"},
+		{"print('''\nMDRIP_BLOCK_EOF\n''', end='')\n", "MDRIP_BLOCK_EOF_1"},
+		{"MDRIP_BLOCK_EOF\nMDRIP_BLOCK_EOF_1\n", "MDRIP_BLOCK_EOF_2"},
+		{"  MDRIP_BLOCK_EOF\necho MDRIP_BLOCK_EOF\n", "MDRIP_BLOCK_EOF"},
+	}
+	for _, test := range tests {
+		if got := hereDocEnd(test.code); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.code, got, test.want)
+		}
+	}
+	b := NewBlockPgm(tests[1].code).SetLanguage("python")
+	out, err := exec.Command("bash", "-e", "-c", b.Script()).CombinedOutput()
+	if err != nil || string(out) != "\nMDRIP_BLOCK_EOF\n" {
+		t.Errorf("got %q, %v, want \"\\nMDRIP_BLOCK_EOF\\n\"", out, err)
+	}
+}
+
+func TestSplitSession(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     string
+		commands string
+		output   string
+	}{
+		{"empty", "", "", ""},
+		{"noOutput", "$ cd /tmp\n$ ls\n", "cd /tmp\nls\n", ""},
+		{"output",
+			"$ echo hi\nhi\n\n$ echo $HOME there\n/root there\n",
+			"echo hi\necho $HOME there\n", "hi\n/root there\n"},
+		{"continued",
+			"$ echo one \\\n> two \\\n  three\none two three\n",
+			"echo one \\\ntwo \\\n  three\n", "one two three\n"},
+		{"barePrompt", "$\n$ date\n...\n", "date\n", "...\n"},
+		{"leadingOutput", "hello\n$ true\n", "true\n", "hello\n"},
+	}
+	for _, test := range tests {
+		commands, output := splitSession(test.code)
+		if commands != test.commands {
+			t.Errorf("%s: got commands %q, want %q", test.name, commands, test.commands)
+		}
+		if output != test.output {
+			t.Errorf("%s: got output %q, want %q", test.name, output, test.output)
+		}
+	}
+}
+
+func TestSessionExpected(t *testing.T) {
+	bParsed := model.NewBlockParsed(
+		[]base.Label{}, base.NoProse(), base.OpaqueCode("$ date\n... 2018\n"))
+	bParsed.SetLanguage("console")
+	b := NewBlockPgmFromBlockTut(model.NewBlockTut(bParsed))
+	e := b.Expected()
+	if e == nil || e.Mode() != base.MatchEllipsis || e.Text() != "... 2018\n" {
+		t.Fatalf("unexpected expectation %v", e)
+	}
+	if b.Commands() != "date\n" {
+		t.Errorf("expected only the command, got %q", b.Commands())
+	}
+	var buf strings.Builder
+	b.Print(&buf, "#", 1, base.WildCardLabel, "foo.md")
+	if strings.Contains(buf.String(), "2018") || !strings.Contains(buf.String(), "\ndate\n") {
+		t.Errorf("expected only the command, got %q", buf.String())
+	}
+	bParsed.SetExpected(base.NewExpectedOutput(base.MatchRegexp, "[0-9]+"))
+	if e := NewBlockPgmFromBlockTut(model.NewBlockTut(bParsed)).Expected(); e.Mode() != base.MatchRegexp {
+		t.Errorf("expected an output fence to win, got %v", e.Mode())
+	}
+}
+
+func TestBlockPgmNeeds(t *testing.T) {
+	bParsed := model.NewBlockParsed(
+		[]base.Label{"main"}, base.NoProse(), base.OpaqueCode("bar"))
+	bParsed.SetAttributes(base.Attributes{"needs": {"init, makeAdder", "more,"}})
+	got := NewBlockPgmFromBlockTut(model.NewBlockTut(bParsed)).Needs()
+	if strings.Join(got, "|") != "init|makeAdder|more" {
+		t.Errorf("got needs %q", got)
+	}
+}
+
+// named returns a block with the given name, needing the given blocks.
+func named(name string, needs ...string) *BlockPgm {
+	b := NewBlockPgm("echo " + name + "\n").SetNeeds(needs)
+	b.name = name
+	return b
+}
+
+// names lists the names of the blocks in each lesson of a program.
+func names(p *Program) string {
+	lessons := []string{}
+	for _, l := range p.Lessons() {
+		blocks := []string{}
+		for _, b := range l.Blocks() {
+			blocks = append(blocks, b.Name())
+		}
+		lessons = append(lessons, string(l.Path())+":"+strings.Join(blocks, ","))
+	}
+	return strings.Join(lessons, " ")
+}
+
+func TestTarget(t *testing.T) {
+	program := func(b ...*BlockPgm) *Program {
+		return NewProgram([]*LessonPgm{
+			NewLessonPgm("a.md", b[:3]), NewLessonPgm("b.md", b[3:])})
+	}
+	p := program(
+		named("init"),
+		named("other"),
+		named("bye").SetCleanup(true),
+		named("makeAdder", "init"),
+		named("makeMain", "makeAdder"),
+		named("unrelated"))
+	for target, want := range map[string]string{
+		"makeMain":       "a.md:init,bye b.md:makeAdder,makeMain",
+		"makeAdder":      "a.md:init,bye b.md:makeAdder",
+		"init":           "a.md:init,bye",
+		"unrelated":      "b.md:unrelated",
+		"other,makeMain": "a.md:init,other,bye b.md:makeAdder,makeMain",
+	} {
+		got, err := p.Target(strings.Split(target, ","))
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", target, err)
+			continue
+		}
+		if names(got) != want {
+			t.Errorf("%s: got %s, want %s", target, names(got), want)
+		}
+	}
+	for _, test := range []struct {
+		name string
+		p    *Program
+		want string
+	}{
+		{"unknown target", p, `no block is named "nope"`},
+		{"unknown need",
+			program(named("init"), named("x", "nope"), named("y"), named("z")),
+			`block x at a.md needs "nope", but no block has that name`},
+		{"cycle",
+			program(named("init", "z"), named("x"), named("y", "init"), named("z", "y")),
+			`blocks need each other in a cycle: init (a.md) -> z (b.md) -> y (a.md) -> init (a.md)`},
+		{"self", program(named("init", "init"), named("x"), named("y"), named("z")),
+			`blocks need each other in a cycle: init (a.md) -> init (a.md)`},
+		{"later",
+			program(named("init", "z"), named("x"), named("y"), named("z")),
+			`block init at a.md needs z, which comes after it at b.md`},
+	} {
+		_, err := test.p.Target([]string{"nope"})
+		if test.name != "unknown target" {
+			_, err = test.p.Target([]string{"init"})
+		}
+		if err == nil || err.Error() != test.want {
+			t.Errorf("%s: got error %v, want %s", test.name, err, test.want)
+		}
+	}
+}
+
+func TestSlice(t *testing.T) {
+	p := NewProgram([]*LessonPgm{
+		NewLessonPgm("dir/a.md", []*BlockPgm{
+			named("init").SetSetup(true),
+			named("one"),
+			named("bye").SetCleanup(true),
+			named("two")}),
+		NewLessonPgm("b.md", []*BlockPgm{
+			named("three"),
+			named("env").SetSetup(true),
+			named("four"),
+			named("five")})})
+	for _, test := range []struct {
+		from, to string
+		want     string
+	}{
+		{"", "", "dir/a.md:init,one,bye,two b.md:three,env,four,five"},
+		{"b:four", "", "dir/a.md:init,bye b.md:env,four,five"},
+		{"four", "", "dir/a.md:init,bye b.md:env,four,five"},
+		{"2:3", "", "dir/a.md:init,bye b.md:env,four,five"},
+		{"b:2", "b:3", "dir/a.md:init,bye b.md:env,four"},
+		{"a:two", "b.md:three", "dir/a.md:init,bye,two b.md:three"},
+		{"dir/a.md:2", "2", "dir/a.md:init,one,bye"},
+		{"", "a:one", "dir/a.md:init,one,bye"},
+	} {
+		got, err := p.Slice(test.from, test.to)
+		if err != nil {
+			t.Errorf("%s to %s: unexpected error %v", test.from, test.to, err)
+			continue
+		}
+		if names(got) != test.want {
+			t.Errorf("%s to %s: got %s, want %s", test.from, test.to, names(got), test.want)
+		}
+	}
+	got, _ := p.Slice("b:4", "")
+	if l := got.Lessons()[1]; l.Index(1) != 3 {
+		t.Errorf("expected block to keep its number, got %d", l.Index(1)+1)
+	}
+	for _, test := range []struct {
+		from, to string
+		want     string
+	}{
+		{"c:1", "", `--from: no block matches "c:1"`},
+		{"", "a:9", `--to: no block matches "a:9"`},
+		{"b:1", "a:1", `--to "a:1" comes before --from "b:1"`},
+	} {
+		if _, err := p.Slice(test.from, test.to); err == nil || err.Error() != test.want {
+			t.Errorf("%s to %s: got error %v, want %s", test.from, test.to, err, test.want)
+		}
+	}
+}
+
+func TestBlockPgmReadiness(t *testing.T) {
+	bParsed := model.NewBlockParsed(
+		[]base.Label{"server"}, base.NoProse(), base.OpaqueCode("serve &\n"))
+	bParsed.SetAttributes(base.Attributes{
+		"wait-port":     {"8080", "db:5432", "nope", "a;b:80"},
+		"wait-file":     {"/tmp/it's ready"},
+		"wait-cmd":      {"curl -s localhost:8080/healthz"},
+		"wait-timeout":  {"2s"},
+		"wait-interval": {"250ms"},
+	})
+	b := NewBlockPgmFromBlockTut(model.NewBlockTut(bParsed))
+	port := `[ -n "${BASH_VERSION:-}" ] || command -v nc >/dev/null 2>&1`
+	want := []Readiness{
+		{"port 8080", "{ (: </dev/tcp/localhost/8080) || nc -z localhost 8080; } >/dev/null 2>&1",
+			port, "bash or nc"},
+		{"port db:5432", "{ (: </dev/tcp/db/5432) || nc -z db 5432; } >/dev/null 2>&1",
+			port, "bash or nc"},
+		{"file /tmp/it's ready", `[ -e '/tmp/it'\''s ready' ]`, "", ""},
+		{`command "curl -s localhost:8080/healthz"`,
+			"(\ncurl -s localhost:8080/healthz\n) >/dev/null 2>&1", "", ""},
+	}
+	got := b.Readiness()
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %v, want %v", got[i], want[i])
+		}
+	}
+	if b.WaitTime() != 8*time.Second {
+		t.Errorf("got wait time %v", b.WaitTime())
+	}
+	script := b.Body()
+	for _, s := range []string{
+		"serve &\nif ! { " + port + "; }; then\n" +
+			"  echo 'mdrip: can'\\''t check port 8080 without bash or nc' >&2\n" +
+			"  false\nelse\n  __mdrip_tries=0\n" +
+			"  until { (: </dev/tcp/localhost/8080) || nc -z localhost 8080; } >/dev/null 2>&1; do\n",
+		"    if [ $__mdrip_tries -ge 8 ]; then\n",
+		"      echo 'mdrip: port 8080 not ready after 2s' >&2\n",
+		"    sleep 0.25\n",
+		"  done\nfi\n",
+	} {
+		if !strings.Contains(script, s) {
+			t.Errorf("expected %q in\n%s", s, script)
+		}
+	}
+	var w strings.Builder
+	b.Print(&w, "#", 1, "server", "a.md")
+	if !strings.HasSuffix(w.String(), "done\n") {
+		t.Errorf("expected print to wait, got\n%s", w.String())
+	}
+}
+
+func TestWaitForPort(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, open, _ := net.SplitHostPort(l.Addr().String())
+	// Directories for PATH holding sleep, and, in withNC, an nc that
+	// says every port is open.
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "mdrip-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	noNC, withNC := dir+"/noNC", dir+"/withNC"
+	for _, d := range []string{noNC, withNC} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(sleep, d+"/sleep"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(withNC+"/nc", []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		shell string
+		port  string
+		path  string
+		err   string
+	}{
+		{"bash", open, noNC, ""},
+		{"bash", "1", noNC, "mdrip: port 127.0.0.1:1 not ready after 300ms"},
+		{"dash", open, withNC, ""},
+		{"dash", open, noNC, "mdrip: can't check port 127.0.0.1:" + open + " without bash or nc"},
+	}
+	for _, test := range tests {
+		shell, err := exec.LookPath(test.shell)
+		if err != nil {
+			t.Logf("no %s: %v", test.shell, err)
+			continue
+		}
+		bParsed := model.NewBlockParsed(nil, base.NoProse(), base.OpaqueCode(""))
+		bParsed.SetAttributes(base.Attributes{
+			"wait-port":     {"127.0.0.1:" + test.port},
+			"wait-timeout":  {"300ms"},
+			"wait-interval": {"100ms"},
+		})
+		b := NewBlockPgmFromBlockTut(model.NewBlockTut(bParsed))
+		cmd := exec.Command(shell, "-e", "-c", b.WaitScript())
+		cmd.Env = []string{"PATH=" + test.path}
+		out, err := cmd.CombinedOutput()
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s, port %s: unexpected error %v: %s", test.shell, test.port, err, out)
+			}
+			continue
+		}
+		if err == nil || strings.TrimSpace(string(out)) != test.err {
+			t.Errorf("%s, port %s: got %q, %v, want %q", test.shell, test.port, out, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package program
+
+import (
+	"fmt"
+	"strings"
+)
+
+// graph holds what blocks need of each other.  Its nodes are the
+// blocks of a program, and a block has an edge to every block bearing
+// a name it lists in needs=.
+type graph struct {
+	blocks []*BlockPgm // In document order.
+	named  map[string][]*BlockPgm
+	lesson map[*BlockPgm]*LessonPgm
+	order  map[*BlockPgm]int
+}
+
+func newGraph(p *Program) *graph {
+	g := &graph{
+		named:  map[string][]*BlockPgm{},
+		lesson: map[*BlockPgm]*LessonPgm{},
+		order:  map[*BlockPgm]int{},
+	}
+	for _, l := range p.lessons {
+		for _, b := range l.blocks {
+			g.order[b] = len(g.blocks)
+			g.blocks = append(g.blocks, b)
+			g.named[b.Name()] = append(g.named[b.Name()], b)
+			g.lesson[b] = l
+		}
+	}
+	return g
+}
+
+// where returns the file and line of a block, for errors.
+func (g *graph) where(b *BlockPgm) string {
+	path := g.lesson[b].path
+	if b.location.Known() {
+		return b.location.InFile(path).String()
+	}
+	return string(path)
+}
+
+// needed returns the blocks the given block needs.  It's an error if
+// one of the names it needs names no block.
+func (g *graph) needed(b *BlockPgm) ([]*BlockPgm, error) {
+	var result []*BlockPgm
+	for _, n := range b.needs {
+		blocks, ok := g.named[n]
+		if !ok {
+			return nil, fmt.Errorf("block %s at %s needs %q, but no block has that name",
+				b.Name(), g.where(b), n)
+		}
+		result = append(result, blocks...)
+	}
+	return result, nil
+}
+
+// check returns an error if a block needs a name that no block has,
+// a block it follows, or, through the blocks it needs, itself.
+func (g *graph) check() error {
+	const (
+		unseen = iota
+		visiting
+		visited
+	)
+	state := map[*BlockPgm]int{}
+	path := []*BlockPgm{}
+	var visit func(b *BlockPgm) error
+	visit = func(b *BlockPgm) error {
+		switch state[b] {
+		case visited:
+			return nil
+		case visiting:
+			return g.cycleError(path, b)
+		}
+		state[b] = visiting
+		path = append(path, b)
+		needed, err := g.needed(b)
+		if err != nil {
+			return err
+		}
+		for _, n := range needed {
+			if err := visit(n); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[b] = visited
+		return nil
+	}
+	for _, b := range g.blocks {
+		if err := visit(b); err != nil {
+			return err
+		}
+	}
+	for _, b := range g.blocks {
+		needed, _ := g.needed(b)
+		for _, n := range needed {
+			if g.order[n] > g.order[b] {
+				return fmt.Errorf("block %s at %s needs %s, which comes after it at %s",
+					b.Name(), g.where(b), n.Name(), g.where(n))
+			}
+		}
+	}
+	return nil
+}
+
+// cycleError describes the cycle that closes when the last block of
+// path needs b.
+func (g *graph) cycleError(path []*BlockPgm, b *BlockPgm) error {
+	i := len(path) - 1
+	for path[i] != b {
+		i--
+	}
+	steps := []string{}
+	for _, x := range append(path[i:], b) {
+		steps = append(steps, fmt.Sprintf("%s (%s)", x.Name(), g.where(x)))
+	}
+	return fmt.Errorf("blocks need each other in a cycle: %s",
+		strings.Join(steps, " -> "))
+}
+
+// Target returns a program holding just the blocks with the given
+// names, the blocks they need, the blocks those need, and so on, in
+// their usual order.  The cleanup blocks of each file the program
+// keeps blocks from are kept too.
+//
+// It's an error if a name, whether given or needed, is that of no
+// block, or if a block needs, however indirectly, itself or a block
+// that follows it.
+func (p *Program) Target(names []string) (*Program, error) {
+	g := newGraph(p)
+	if err := g.check(); err != nil {
+		return nil, err
+	}
+	keep := map[*BlockPgm]bool{}
+	var add func(b *BlockPgm)
+	add = func(b *BlockPgm) {
+		if keep[b] {
+			return
+		}
+		keep[b] = true
+		needed, _ := g.needed(b)
+		for _, n := range needed {
+			add(n)
+		}
+	}
+	for _, n := range names {
+		blocks, ok := g.named[n]
+		if !ok {
+			return nil, fmt.Errorf("no block is named %q", n)
+		}
+		for _, b := range blocks {
+			add(b)
+		}
+	}
+	return p.keeping(keep), nil
+}
@@ -0,0 +1,83 @@
+package program
+
+import (
+	"fmt"
+	"strings"
+)
+
+// An Interpreter turns the code of a block into bash that runs it.
+//
+// Blocks in languages other than bash still run as part of a bash
+// script, so that they see the environment and working directory
+// left by earlier blocks, and report their exit status like any
+// other block.
+type Interpreter func(code string) string
+
+// interpreters maps the language named by a fence's info string to
+// the interpreter for blocks in that language.  A fence with no info
+// string holds bash, as do session transcripts, once stripped of
+// prompts and output.  Blocks marked as being in another shell run
+// in bash too, since tutorials label their shell blocks sh or zsh
+// freely, and expect an export or cd in one to hold for the next.
+var interpreters = map[string]Interpreter{
+	"":              bashCode,
+	"bash":          bashCode,
+	"shell":         bashCode,
+	"console":       sessionCode,
+	"shell-session": sessionCode,
+	"shellsession":  sessionCode,
+	"sh":            bashCode,
+	"zsh":           bashCode,
+	"python":        viaFile("python3", "py"),
+	"python3":       viaFile("python3", "py"),
+	"py":            viaFile("python3", "py"),
+	"go":            viaFile("go run", "go"),
+}
+
+// RegisterInterpreter arranges for blocks in the given language to
+// be run by the given interpreter, replacing any other.
+func RegisterInterpreter(language string, i Interpreter) {
+	interpreters[strings.ToLower(language)] = i
+}
+
+// InterpreterFor returns the interpreter for the given language.
+func InterpreterFor(language string) (Interpreter, bool) {
+	i, ok := interpreters[strings.ToLower(language)]
+	return i, ok
+}
+
+func bashCode(code string) string {
+	return code
+}
+
+// hereDocEnd returns a word to end the here document holding the
+// given code: MDRIP_BLOCK_EOF, with a numeric suffix if need be so
+// that no line of the code ends the document early.
+func hereDocEnd(code string) string {
+	lines := map[string]bool{}
+	for _, line := range strings.Split(code, "\n") {
+		lines[line] = true
+	}
+	end := "MDRIP_BLOCK_EOF"
+	for n := 1; lines[end]; n++ {
+		end = fmt.Sprintf("MDRIP_BLOCK_EOF_%d", n)
+	}
+	return end
+}
+
+// viaFile returns an interpreter that writes the code to a file with
+// the given extension, in a temporary directory, and runs the given
+// command on it.  All this happens in a subshell, whose exit status
+// is that of the command.
+func viaFile(command, ext string) Interpreter {
+	return func(code string) string {
+		end := hereDocEnd(code)
+		var b strings.Builder
+		fmt.Fprintf(&b, "(\n__mdrip_dir=$(mktemp -d)\n")
+		fmt.Fprintf(&b, "trap 'rm -rf \"$__mdrip_dir\"' EXIT\n")
+		fmt.Fprintf(&b, "cat >\"$__mdrip_dir/block.%s\" <<'%s'\n", ext, end)
+		fmt.Fprintf(&b, "%s\n%s\n", strings.TrimSuffix(code, "\n"), end)
+		fmt.Fprintf(&b, "%s \"$__mdrip_dir/block.%s\"\n)\n", command, ext)
+		return b.String()
+	}
+}
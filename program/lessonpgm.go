@@ -12,16 +12,45 @@ import (
 type LessonPgm struct {
 	path   base.FilePath
 	blocks []*BlockPgm
+	// indexes holds the index each block had before some were cut
+	// away, e.g. by Program.Target; nil if none were.
+	indexes []int
 }
 
 func NewLessonPgm(p base.FilePath, blocks []*BlockPgm) *LessonPgm {
-	return &LessonPgm{p, blocks}
+	return &LessonPgm{p, blocks, nil}
 }
 
 func (l *LessonPgm) Name() string        { return l.path.Base() }
 func (l *LessonPgm) Path() base.FilePath { return l.path }
 func (l *LessonPgm) Blocks() []*BlockPgm { return l.blocks }
 
+// Index returns the index that the i'th block had in the lesson
+// before any blocks were cut from it, so that a block keeps its
+// number however the lesson is cut.
+func (l *LessonPgm) Index(i int) int {
+	if l.indexes == nil {
+		return i
+	}
+	return l.indexes[i]
+}
+
+// keeping returns a lesson holding just the blocks for which keep
+// is true, or nil if there are none.
+func (l *LessonPgm) keeping(keep func(b *BlockPgm) bool) *LessonPgm {
+	result := &LessonPgm{l.path, []*BlockPgm{}, []int{}}
+	for i, b := range l.blocks {
+		if keep(b) {
+			result.blocks = append(result.blocks, b)
+			result.indexes = append(result.indexes, l.Index(i))
+		}
+	}
+	if len(result.blocks) == 0 {
+		return nil
+	}
+	return result
+}
+
 // Print sends contents to the given Writer.
 //
 // If n <= 0, print everything, else only print the first n blocks.
@@ -36,7 +65,7 @@ func (l *LessonPgm) Print(w io.Writer, label base.Label, n int) {
 			break
 		}
 		fmt.Fprintf(w, delimFmt, "Start", i+1, len(l.blocks))
-		block.Print(w, "#", i+1, label, l.path)
+		block.Print(w, "#", l.Index(i)+1, label, l.path)
 		fmt.Fprintf(w, delimFmt, "End", i+1, len(l.blocks))
 		fmt.Fprintln(w)
 	}
@@ -10,14 +10,17 @@ import (
 // are edited - only blocks with the given label are carried over
 // into the new extracted lessons.  If a lesson has no blocks with
 // the given label, it is completely dropped.
+//
+// The label may hold an expression over labels, e.g. "lesson1,!slow";
+// see base.Selector.
 type LessonPgmExtractor struct {
-	label      base.Label
+	selector   base.Selector
 	lessons    []*LessonPgm
 	blockAccum []*BlockPgm
 }
 
 func NewLessonPgmExtractor(label base.Label) *LessonPgmExtractor {
-	return &LessonPgmExtractor{label, []*LessonPgm{}, []*BlockPgm{}}
+	return &LessonPgmExtractor{base.SelectorFor(label), []*LessonPgm{}, []*BlockPgm{}}
 }
 
 func (v *LessonPgmExtractor) Lessons() []*LessonPgm {
@@ -25,7 +28,7 @@ func (v *LessonPgmExtractor) Lessons() []*LessonPgm {
 }
 
 func (v *LessonPgmExtractor) VisitBlockTut(b *model.BlockTut) {
-	if v.label == base.WildCardLabel || b.HasLabel(v.label) {
+	if v.selector.Matches(b.Labels()) {
 		v.blockAccum = append(v.blockAccum, NewBlockPgmFromBlockTut(b))
 	}
 }
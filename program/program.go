@@ -30,6 +30,21 @@ func NewProgramFromTutorial(l base.Label, t model.Tutorial) *Program {
 	return &Program{l, v.Lessons()}
 }
 
+// keeping returns a program holding just the blocks in keep, along
+// with the cleanup blocks of each lesson it keeps blocks from.
+func (p *Program) keeping(keep map[*BlockPgm]bool) *Program {
+	lessons := []*LessonPgm{}
+	for _, l := range p.lessons {
+		if l.keeping(func(b *BlockPgm) bool { return keep[b] }) == nil {
+			continue
+		}
+		lessons = append(lessons, l.keeping(func(b *BlockPgm) bool {
+			return keep[b] || b.IsCleanup()
+		}))
+	}
+	return &Program{p.label, lessons}
+}
+
 // PrintNormal simply prints the contents of a program.
 func (p Program) PrintNormal(w io.Writer) {
 	for _, s := range p.lessons {
@@ -0,0 +1,117 @@
+package program
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/monopole/mdrip/base"
+	"github.com/monopole/mdrip/model"
+	"github.com/monopole/mdrip/util"
+)
+
+// How long a block waits for its readiness conditions, and how often
+// it checks them, unless it says otherwise.
+const (
+	DefaultWaitTimeout  = 30 * time.Second
+	DefaultWaitInterval = 500 * time.Millisecond
+)
+
+// A Readiness is a condition to wait for once a block's code has run,
+// e.g. that a server the block started in the background is listening
+// on its port.
+type Readiness struct {
+	// What is waited for, e.g. "port 8080", for messages.
+	What string
+	// Check is shell that succeeds once the condition holds.
+	Check string
+	// Require, if given, is shell that succeeds if Check can work at
+	// all in the shell at hand, and Lacking says what's missing if
+	// not.
+	Require, Lacking string
+}
+
+// hostName matches the host names and addresses a port check may
+// name, which go into the check unquoted.
+var hostName = regexp.MustCompile(`^[A-Za-z0-9_.:-]+$`)
+
+// readinessOf reads a block's readiness conditions from its
+// wait-port, wait-file and wait-cmd attributes, dropping any that
+// make no sense.
+func readinessOf(b *model.BlockTut) []Readiness {
+	var result []Readiness
+	a := b.Attributes()
+	for _, v := range a.All(base.WaitPortAttr) {
+		host, port := "localhost", v
+		if h, p, err := net.SplitHostPort(v); err == nil {
+			host, port = h, p
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 ||
+			!hostName.MatchString(host) {
+			glog.Warningf("block %s: bad %s %q, expecting [host:]port", b.Name(), base.WaitPortAttr, v)
+			continue
+		}
+		result = append(result, Readiness{
+			"port " + v,
+			fmt.Sprintf("{ (: </dev/tcp/%s/%s) || nc -z %s %s; } >/dev/null 2>&1",
+				host, port, host, port),
+			`[ -n "${BASH_VERSION:-}" ] || command -v nc >/dev/null 2>&1`,
+			"bash or nc"})
+	}
+	for _, v := range a.All(base.WaitFileAttr) {
+		result = append(result, Readiness{
+			"file " + v, "[ -e " + util.ShellQuote(v) + " ]", "", ""})
+	}
+	for _, v := range a.All(base.WaitCmdAttr) {
+		result = append(result, Readiness{
+			"command " + strconv.Quote(v), "(\n" + v + "\n) >/dev/null 2>&1", "", ""})
+	}
+	return result
+}
+
+// waitDuration reads a positive duration from the given attribute,
+// or returns the default.
+func waitDuration(b *model.BlockTut, key string, d time.Duration) time.Duration {
+	v, ok, err := b.Attributes().Duration(key)
+	if err != nil {
+		glog.Warningf("block %s: %v, using %v", b.Name(), err, d)
+		return d
+	}
+	if ok {
+		return v
+	}
+	return d
+}
+
+// waitLoop returns shell that checks the condition every interval,
+// going on once it holds.  If it still doesn't hold after timeout,
+// the loop writes why to stderr and fails, which under "bash -e"
+// ends the shell.  It fails at once if the condition can't be
+// checked at all, e.g. a port in a shell that's neither bash, with
+// its /dev/tcp, nor has nc.  Only POSIX shell constructs are used,
+// so that printed scripts wait under sh or dash too.
+func waitLoop(r Readiness, timeout, interval time.Duration) string {
+	tries := int(math.Ceil(float64(timeout) / float64(interval)))
+	var b strings.Builder
+	fmt.Fprintf(&b, "__mdrip_tries=0\n")
+	fmt.Fprintf(&b, "until %s; do\n", r.Check)
+	fmt.Fprintf(&b, "  __mdrip_tries=$((__mdrip_tries + 1))\n")
+	fmt.Fprintf(&b, "  if [ $__mdrip_tries -ge %d ]; then\n", tries)
+	fmt.Fprintf(&b, "    echo %s >&2\n",
+		util.ShellQuote(fmt.Sprintf("mdrip: %s not ready after %v", r.What, timeout)))
+	fmt.Fprintf(&b, "    false\n    break\n  fi\n")
+	fmt.Fprintf(&b, "  sleep %s\n", strconv.FormatFloat(interval.Seconds(), 'f', -1, 64))
+	fmt.Fprintf(&b, "done\n")
+	if r.Require == "" {
+		return b.String()
+	}
+	return fmt.Sprintf("if ! { %s; }; then\n  echo %s >&2\n  false\nelse\n%sfi\n",
+		r.Require, util.ShellQuote(fmt.Sprintf(
+			"mdrip: can't check %s without %s", r.What, r.Lacking)),
+		util.Indent(b.String(), 2))
+}
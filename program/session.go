@@ -0,0 +1,80 @@
+package program
+
+import (
+	"strings"
+
+	"github.com/monopole/mdrip/base"
+)
+
+// A session block, e.g. one fenced as console, is a transcript of a
+// shell session: each command follows a "$ " prompt, and is followed
+// by what it wrote.  A command line ending in a backslash continues
+// on the next line, which may start with a "> " prompt.
+const (
+	sessionPrompt      = "$ "
+	continuationPrompt = "> "
+)
+
+// isSession is true if blocks in the language are session transcripts.
+func isSession(language string) bool {
+	switch strings.ToLower(language) {
+	case "console", "shell-session", "shellsession":
+		return true
+	}
+	return false
+}
+
+// splitSession splits a session transcript into its commands, prompts
+// removed, and the output the commands are shown writing.  Blank
+// lines at the end of a command's output are taken to be there for
+// legibility, and dropped.
+func splitSession(code string) (commands, output string) {
+	var cmds, out strings.Builder
+	var pending []string // The current command's output.
+	flush := func() {
+		for len(pending) > 0 && strings.TrimSpace(pending[len(pending)-1]) == "" {
+			pending = pending[:len(pending)-1]
+		}
+		for _, line := range pending {
+			out.WriteString(line + "\n")
+		}
+		pending = nil
+	}
+	continued := false
+	for _, line := range strings.Split(strings.TrimRight(code, "\n"), "\n") {
+		switch {
+		case continued:
+			line = strings.TrimPrefix(line, continuationPrompt)
+		case line == strings.TrimSpace(sessionPrompt):
+			flush()
+			continue
+		case strings.HasPrefix(line, sessionPrompt):
+			flush()
+			line = strings.TrimPrefix(line, sessionPrompt)
+		default:
+			pending = append(pending, line)
+			continue
+		}
+		cmds.WriteString(line + "\n")
+		continued = strings.HasSuffix(line, "\\")
+	}
+	flush()
+	return cmds.String(), out.String()
+}
+
+// sessionCode keeps the commands of a session transcript.
+func sessionCode(code string) string {
+	commands, _ := splitSession(code)
+	return commands
+}
+
+// sessionExpected returns what a session transcript shows its commands
+// writing, with "..." standing for text that varies from run to run,
+// or nil if it shows no output at all.
+func sessionExpected(code string) *base.ExpectedOutput {
+	_, output := splitSession(code)
+	if output == "" {
+		return nil
+	}
+	return base.NewExpectedOutput(base.MatchEllipsis, output)
+}
@@ -0,0 +1,80 @@
+package program
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// position is where a block is in a program: the index of its
+// lesson, and its index in that lesson.
+type position struct {
+	lesson, block int
+}
+
+func (p position) before(q position) bool {
+	return p.lesson < q.lesson || p.lesson == q.lesson && p.block < q.block
+}
+
+// find returns the position of the first block matching spec, which
+// looks like lesson:block or just block.  The lesson may be given by
+// name, path or number, and the block by name or number, numbers
+// counting from 1.  A block's number is the one it had before any
+// blocks were cut from its lesson, i.e. the one shown in reports.
+// With no lesson, any lesson will do.
+func (p *Program) find(spec string) (position, error) {
+	lesson, block := "", spec
+	if i := strings.LastIndex(spec, ":"); i >= 0 {
+		lesson, block = spec[:i], spec[i+1:]
+	}
+	for i, l := range p.lessons {
+		if lesson != "" && lesson != l.Name() && lesson != string(l.path) &&
+			lesson != strconv.Itoa(i+1) {
+			continue
+		}
+		for j, b := range l.blocks {
+			if block == b.Name() || block == strconv.Itoa(l.Index(j)+1) {
+				return position{i, j}, nil
+			}
+		}
+	}
+	return position{}, fmt.Errorf("no block matches %q", spec)
+}
+
+// Slice returns a program holding just the blocks from the one
+// matching from to the one matching to, inclusive; see find for what
+// matches.  An empty from means the first block, and an empty to the
+// last.  Blocks labelled @setup that precede from are kept, as are the
+// cleanup blocks of each lesson the program keeps blocks from.
+func (p *Program) Slice(from, to string) (*Program, error) {
+	if len(p.lessons) == 0 {
+		return p, nil
+	}
+	start := position{0, 0}
+	last := len(p.lessons) - 1
+	end := position{last, len(p.lessons[last].blocks) - 1}
+	var err error
+	if from != "" {
+		if start, err = p.find(from); err != nil {
+			return nil, fmt.Errorf("--from: %v", err)
+		}
+	}
+	if to != "" {
+		if end, err = p.find(to); err != nil {
+			return nil, fmt.Errorf("--to: %v", err)
+		}
+	}
+	if end.before(start) {
+		return nil, fmt.Errorf("--to %q comes before --from %q", to, from)
+	}
+	keep := map[*BlockPgm]bool{}
+	for i, l := range p.lessons {
+		for j, b := range l.blocks {
+			at := position{i, j}
+			if at.before(start) && b.IsSetup() || !at.before(start) && !end.before(at) {
+				keep[b] = true
+			}
+		}
+	}
+	return p.keeping(keep), nil
+}
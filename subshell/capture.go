@@ -0,0 +1,86 @@
+package subshell
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+
+	"github.com/golang/glog"
+	"github.com/monopole/mdrip/util"
+)
+
+// streamCapture follows what a shell writes to one of its output
+// streams.  The shell writes to a file rather than a pipe, so that at
+// any moment the file's size says exactly how much has been written,
+// and the output can be cut into per-block pieces as blocks finish.
+type streamCapture struct {
+	stream Stream
+	file   *os.File // The shell writes here; mdrip reads here.
+	start  int64    // Where the current block's output begins.
+	read   int64    // How far lines have been handed out.
+}
+
+func newStreamCapture(s Stream) *streamCapture {
+	f, err := ioutil.TempFile("", "mdrip-"+string(s)+"-")
+	util.Check("create "+string(s)+" file", err)
+	return &streamCapture{s, f, 0, 0}
+}
+
+// size returns how much the shell has written so far.
+func (c *streamCapture) size() int64 {
+	info, err := c.file.Stat()
+	if err != nil {
+		glog.Errorf("unable to stat %s: %v", c.file.Name(), err)
+		return c.read
+	}
+	return info.Size()
+}
+
+// between returns what was written from offset a to offset b.
+func (c *streamCapture) between(a, b int64) []byte {
+	if b <= a {
+		return nil
+	}
+	buf := make([]byte, b-a)
+	n, err := c.file.ReadAt(buf, a)
+	if err != nil && n < len(buf) {
+		glog.Errorf("unable to read %s: %v", c.file.Name(), err)
+	}
+	return buf[:n]
+}
+
+// poll hands each complete line written since the last poll to
+// onLine.
+func (c *streamCapture) poll(onLine func(Stream, string)) {
+	data := c.between(c.read, c.size())
+	end := bytes.LastIndexByte(data, '\n')
+	if end < 0 {
+		return
+	}
+	for _, line := range bytes.Split(data[:end], []byte("\n")) {
+		onLine(c.stream, string(line))
+	}
+	c.read += int64(end + 1)
+}
+
+// cut returns everything written since the last cut, first handing
+// any lines not yet handed out to onLine, the last one even if it
+// lacks a newline.
+func (c *streamCapture) cut(onLine func(Stream, string)) string {
+	end := c.size()
+	rest := c.between(c.read, end)
+	if len(rest) > 0 {
+		for _, line := range bytes.Split(bytes.TrimSuffix(rest, []byte("\n")), []byte("\n")) {
+			onLine(c.stream, string(line))
+		}
+	}
+	result := string(c.between(c.start, end))
+	c.start, c.read = end, end
+	return result
+}
+
+// close closes and removes the file.
+func (c *streamCapture) close() {
+	util.Check("close "+string(c.stream)+" file", c.file.Close())
+	util.Check("delete "+string(c.stream)+" file", os.Remove(c.file.Name()))
+}
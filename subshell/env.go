@@ -0,0 +1,92 @@
+package subshell
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/monopole/mdrip/util"
+)
+
+// ReadEnvFile reads NAME=value settings from a file, one per line,
+// as for docker's --env-file.  Blank lines and lines starting with #
+// are ignored, a leading "export " is dropped, and a value wholly in
+// single or double quotes loses them.  Nothing is expanded.
+func ReadEnvFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	result := []string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		name, value, ok := util.SplitEnv(line)
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expecting NAME=value, got %q", path, n, line)
+		}
+		if len(value) > 1 && (value[0] == '"' || value[0] == '\'') &&
+			value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		result = append(result, name+"="+value)
+	}
+	return result, scanner.Err()
+}
+
+// setEnv returns env with the given settings applied in order, each
+// replacing any earlier setting of the same variable.
+func setEnv(env []string, settings []string) []string {
+	result := append([]string{}, env...)
+	at := map[string]int{}
+	for i, v := range result {
+		if name, _, ok := util.SplitEnv(v); ok {
+			at[name] = i
+		}
+	}
+	for _, v := range settings {
+		name, _, _ := util.SplitEnv(v)
+		if i, ok := at[name]; ok {
+			result[i] = v
+			continue
+		}
+		at[name] = len(result)
+		result = append(result, v)
+	}
+	return result
+}
+
+// keepEnv returns the settings in env of the named variables.
+func keepEnv(env []string, names []string) []string {
+	keep := map[string]bool{}
+	for _, n := range names {
+		keep[n] = true
+	}
+	result := []string{}
+	for _, v := range env {
+		if name, _, ok := util.SplitEnv(v); ok && keep[name] {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// shellEnv returns the environment shells run in, or nil if they
+// inherit mdrip's own untouched, and the settings a report should
+// record: just those given, or, in a clean environment, all of it.
+func (s *Subshell) shellEnv() (env, recorded []string) {
+	if !s.cleanEnv {
+		if len(s.env) == 0 {
+			return nil, nil
+		}
+		return setEnv(os.Environ(), s.env), setEnv(nil, s.env)
+	}
+	env = setEnv(keepEnv(os.Environ(), s.keepEnv), s.env)
+	return env, env
+}
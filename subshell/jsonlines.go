@@ -0,0 +1,107 @@
+package subshell
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// jsonEvent is one line of JSON lines output.  Fields not relevant
+// to the event are omitted.
+type jsonEvent struct {
+	Event      string   `json:"event"`
+	Time       string   `json:"time"`
+	File       string   `json:"file,omitempty"`
+	Index      *int     `json:"index,omitempty"`
+	Name       string   `json:"name,omitempty"`
+	Cleanup    bool     `json:"cleanup,omitempty"`
+	Session    string   `json:"session,omitempty"`
+	Stream     Stream   `json:"stream,omitempty"`
+	Line       *string  `json:"line,omitempty"`
+	Status     string   `json:"status,omitempty"`
+	Message    string   `json:"message,omitempty"`
+	ExitCode   *int     `json:"exitCode,omitempty"`
+	DurationMs *int64   `json:"durationMs,omitempty"`
+	Passed     *int     `json:"passed,omitempty"`
+	Failed     *int     `json:"failed,omitempty"`
+	Skipped    *int     `json:"skipped,omitempty"`
+	Env        []string `json:"env,omitempty"`
+	CleanEnv   bool     `json:"cleanEnv,omitempty"`
+}
+
+// JsonLinesListener streams events as newline-delimited JSON.
+type JsonLinesListener struct {
+	enc *json.Encoder
+}
+
+func NewJsonLinesListener(w io.Writer) *JsonLinesListener {
+	return &JsonLinesListener{json.NewEncoder(w)}
+}
+
+func (x *JsonLinesListener) emit(e *jsonEvent) {
+	e.Time = time.Now().Format(time.RFC3339Nano)
+	if err := x.enc.Encode(e); err != nil {
+		glog.Errorf("unable to write json event: %v", err)
+	}
+}
+
+func blockEvent(event string, b *BlockReport) *jsonEvent {
+	index := b.Index()
+	return &jsonEvent{
+		Event: event, File: string(b.FileName()), Index: &index, Name: b.Name(),
+		Cleanup: b.Block().IsCleanup(), Session: b.Block().Session()}
+}
+
+func tallies(e *jsonEvent, passed, failed, skipped int) *jsonEvent {
+	e.Passed, e.Failed, e.Skipped = &passed, &failed, &skipped
+	return e
+}
+
+func (x *JsonLinesListener) RunStarted(r *RunReport) {
+	x.emit(&jsonEvent{Event: "runStarted", Env: r.Env(), CleanEnv: r.CleanEnv()})
+}
+
+func (x *JsonLinesListener) BlockStarted(b *BlockReport) {
+	x.emit(blockEvent("blockStarted", b))
+}
+
+func (x *JsonLinesListener) BlockOutput(b *BlockReport, s Stream, line string) {
+	e := blockEvent("blockOutput", b)
+	e.Stream = s
+	e.Line = &line
+	x.emit(e)
+}
+
+func (x *JsonLinesListener) BlockFinished(b *BlockReport) {
+	e := blockEvent("blockFinished", b)
+	code := b.ExitCode()
+	ms := b.Duration().Milliseconds()
+	e.Status, e.ExitCode, e.DurationMs = b.Status().String(), &code, &ms
+	e.Message = b.Message()
+	x.emit(e)
+}
+
+func (x *JsonLinesListener) LessonFinished(l *LessonReport) {
+	x.emit(tallies(
+		&jsonEvent{Event: "lessonFinished", File: string(l.Path())},
+		l.Count(StatusPassed),
+		l.Count(StatusFailed)+l.Count(StatusTimedOut),
+		l.Count(StatusSkipped)))
+}
+
+func (x *JsonLinesListener) RunFinished(r *RunReport) {
+	ms := r.Duration().Milliseconds()
+	e := tallies(
+		&jsonEvent{Event: "runFinished", DurationMs: &ms},
+		r.Count(StatusPassed),
+		r.Count(StatusFailed)+r.Count(StatusTimedOut),
+		r.Count(StatusSkipped))
+	if r.Problem() != nil {
+		e.Status = "FAIL"
+	} else {
+		e.Status = "PASS"
+	}
+	x.emit(e)
+}
@@ -0,0 +1,149 @@
+package subshell
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/monopole/mdrip/util"
+)
+
+// The JUnit XML schema is informal; this follows the subset
+// understood by Jenkins, GitLab and friends.
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Time     string          `xml:"time,attr"`
+	Props    []junitProperty `xml:"properties>property,omitempty"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+	SystemErr string        `xml:"system-err,omitempty"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Body    string `xml:",chardata"`
+}
+
+func junitSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+func newJUnitTestCase(l *LessonReport, b *BlockReport) junitTestCase {
+	tc := junitTestCase{
+		Name:      fmt.Sprintf("%02d_%s", b.Index()+1, b.Name()),
+		ClassName: junitClassName(l, b),
+		Time:      junitSeconds(b.Duration()),
+		SystemOut: b.StdOut(),
+		SystemErr: b.StdErr(),
+	}
+	switch {
+	case b.Status() == StatusSkipped:
+		tc.Skipped = &junitSkipped{b.Message()}
+	case b.Failed():
+		why := fmt.Sprintf("exited with status %d", b.ExitCode())
+		if len(b.Message()) > 0 {
+			why = strings.SplitN(b.Message(), "\n", 2)[0]
+		}
+		tc.Failure = &junitFailure{
+			Message: fmt.Sprintf("block %d (%s) in %s %s",
+				b.Index()+1, b.Name(), b.Where(), why),
+			Type: b.Status().String(),
+			Body: b.Message() + b.StdOut() + b.StdErr(),
+		}
+		if len(b.Killed()) > 0 {
+			tc.Failure.Body += "Killed processes:\n" + describeKilled(b.Killed())
+		}
+	}
+	return tc
+}
+
+// junitClassName puts cleanup blocks in a class of their own, so
+// that they show up apart from the blocks they clean up after.
+func junitClassName(l *LessonReport, b *BlockReport) string {
+	if b.Block().IsCleanup() {
+		return l.Lesson().Name() + ".cleanup"
+	}
+	return l.Lesson().Name()
+}
+
+// junitProperties describes the environment the shells were given,
+// as env.NAME properties, and cleanEnv if that was all they got.
+func junitProperties(r *RunReport) []junitProperty {
+	result := []junitProperty{}
+	if r.CleanEnv() {
+		result = append(result, junitProperty{"cleanEnv", "true"})
+	}
+	for _, v := range r.Env() {
+		name, value, _ := util.SplitEnv(v)
+		result = append(result, junitProperty{"env." + name, value})
+	}
+	return result
+}
+
+// WriteJUnit writes the report as JUnit XML, with a testsuite per
+// lesson and a testcase per block.  Each testsuite holds the
+// environment the shells were given as properties.
+func WriteJUnit(w io.Writer, r *RunReport) error {
+	all := junitTestSuites{Time: junitSeconds(r.Duration())}
+	props := junitProperties(r)
+	for _, l := range r.Lessons() {
+		suite := junitTestSuite{
+			Name:     string(l.Path()),
+			Tests:    len(l.AllBlocks()),
+			Failures: l.Count(StatusFailed) + l.Count(StatusTimedOut),
+			Skipped:  l.Count(StatusSkipped),
+			Time:     junitSeconds(l.Duration()),
+			Props:    props,
+		}
+		for _, b := range l.AllBlocks() {
+			suite.Cases = append(suite.Cases, newJUnitTestCase(l, b))
+		}
+		all.Tests += suite.Tests
+		all.Failures += suite.Failures
+		all.Skipped += suite.Skipped
+		all.Suites = append(all.Suites, suite)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(all); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,72 @@
+package subshell
+
+import (
+	"bytes"
+	"encoding/xml"
+	"reflect"
+	"testing"
+
+	"github.com/monopole/mdrip/base"
+	"github.com/monopole/mdrip/program"
+)
+
+func TestWriteJUnit(t *testing.T) {
+	blocks := []*program.BlockPgm{
+		makeBlock("echo kale\n"),
+		makeBlock("echo beans\nlochNessMonster\n").SetLocation(base.Location{Line: 12}),
+		makeBlock("echo hasta\n")}
+	var out bytes.Buffer
+	if err := WriteJUnit(&out, doIt(blocks)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got junitTestSuites
+	if err := xml.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("unable to read back xml: %v\n%s", err, out.String())
+	}
+	if got.Tests != 3 || got.Failures != 1 || got.Skipped != 1 {
+		t.Errorf("wrong totals: %+v", got)
+	}
+	if len(got.Suites) != 1 || got.Suites[0].Name != "foo" {
+		t.Fatalf("expected one suite named foo, got %+v", got.Suites)
+	}
+	cases := got.Suites[0].Cases
+	if len(cases) != 3 {
+		t.Fatalf("expected 3 cases, got %d", len(cases))
+	}
+	if cases[0].Failure != nil || cases[0].Skipped != nil {
+		t.Errorf("first case should pass: %+v", cases[0])
+	}
+	f := cases[1].Failure
+	if f == nil {
+		t.Fatalf("second case should fail: %+v", cases[1])
+	}
+	if want := "block 2 (noNameBlock) in foo:12 exited with status 127"; f.Message != want {
+		t.Errorf("got failure message %q, want %q", f.Message, want)
+	}
+	if !bytes.Contains([]byte(f.Body), []byte("lochNessMonster: command not found")) {
+		t.Errorf("failure body lacks stderr: %q", f.Body)
+	}
+	if cases[2].Skipped == nil {
+		t.Errorf("third case should be skipped: %+v", cases[2])
+	}
+	if len(got.Suites[0].Props) != 0 {
+		t.Errorf("expected no properties, got %+v", got.Suites[0].Props)
+	}
+}
+
+func TestWriteJUnitEnv(t *testing.T) {
+	r := doIt([]*program.BlockPgm{makeBlock("echo kale\n")}).
+		SetEnv([]string{"A=1", "B=x=y"}, true)
+	var out bytes.Buffer
+	if err := WriteJUnit(&out, r); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got junitTestSuites
+	if err := xml.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("unable to read back xml: %v\n%s", err, out.String())
+	}
+	want := []junitProperty{{"cleanEnv", "true"}, {"env.A", "1"}, {"env.B", "x=y"}}
+	if !reflect.DeepEqual(got.Suites[0].Props, want) {
+		t.Errorf("got properties %+v, want %+v", got.Suites[0].Props, want)
+	}
+}
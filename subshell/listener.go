@@ -0,0 +1,166 @@
+package subshell
+
+import (
+	"sync"
+)
+
+// Stream names the origin of a line of block output.
+type Stream string
+
+const (
+	StreamStdOut = Stream("stdout")
+	StreamStdErr = Stream("stderr")
+)
+
+// Listener is told about progress while a program runs, so that
+// results may be streamed rather than printed at the end.
+//
+// Every block gets a BlockFinished call - blocks that never ran are
+// finished with StatusSkipped and have no BlockStarted call.
+type Listener interface {
+	RunStarted(r *RunReport)
+	BlockStarted(b *BlockReport)
+	BlockOutput(b *BlockReport, s Stream, line string)
+	BlockFinished(b *BlockReport)
+	LessonFinished(l *LessonReport)
+	RunFinished(r *RunReport)
+}
+
+// outputLine is a line of block output awaiting delivery.
+type outputLine struct {
+	s    Stream
+	line string
+}
+
+// eventSerializer forwards events to listeners one at a time and in
+// a sensible order.  Blocks of different lessons may run at once, in
+// different shells.  Output lines for a block not yet announced as
+// started are held until it is.
+//
+// A lesson is finished as soon as all its blocks, cleanup blocks
+// included, are finished.
+type eventSerializer struct {
+	mu        sync.Mutex
+	listeners []Listener
+	report    *RunReport
+	started   map[*BlockReport]bool
+	finished  map[*BlockReport]bool
+	done      map[*LessonReport]bool
+	pending   map[*BlockReport][]outputLine
+	lessonOf  map[*BlockReport]*LessonReport
+}
+
+func newEventSerializer(ls []Listener, r *RunReport) *eventSerializer {
+	lessonOf := map[*BlockReport]*LessonReport{}
+	for _, lr := range r.Lessons() {
+		for _, b := range lr.AllBlocks() {
+			lessonOf[b] = lr
+		}
+	}
+	return &eventSerializer{
+		listeners: ls,
+		report:    r,
+		started:   map[*BlockReport]bool{},
+		finished:  map[*BlockReport]bool{},
+		done:      map[*LessonReport]bool{},
+		pending:   map[*BlockReport][]outputLine{},
+		lessonOf:  lessonOf,
+	}
+}
+
+func (e *eventSerializer) runStarted() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, l := range e.listeners {
+		l.RunStarted(e.report)
+	}
+}
+
+func (e *eventSerializer) blockStarted(b *BlockReport) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.startLocked(b)
+}
+
+func (e *eventSerializer) startLocked(b *BlockReport) {
+	if e.started[b] {
+		return
+	}
+	e.started[b] = true
+	for _, l := range e.listeners {
+		l.BlockStarted(b)
+	}
+	for _, o := range e.pending[b] {
+		e.outputLocked(b, o)
+	}
+	delete(e.pending, b)
+}
+
+// blockOutput reports a line of output from the given block.
+func (e *eventSerializer) blockOutput(b *BlockReport, s Stream, line string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.started[b] {
+		e.pending[b] = append(e.pending[b], outputLine{s, line})
+		return
+	}
+	e.outputLocked(b, outputLine{s, line})
+}
+
+func (e *eventSerializer) outputLocked(b *BlockReport, o outputLine) {
+	for _, l := range e.listeners {
+		l.BlockOutput(b, o.s, o.line)
+	}
+}
+
+func (e *eventSerializer) blockFinished(b *BlockReport) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.finishLocked(b)
+}
+
+func (e *eventSerializer) finishLocked(b *BlockReport) {
+	if e.finished[b] {
+		return
+	}
+	e.finished[b] = true
+	for _, l := range e.listeners {
+		l.BlockFinished(b)
+	}
+	lr := e.lessonOf[b]
+	if lr == nil {
+		return
+	}
+	for _, other := range lr.AllBlocks() {
+		if !e.finished[other] {
+			return
+		}
+	}
+	e.lessonFinishedLocked(lr)
+}
+
+func (e *eventSerializer) lessonFinishedLocked(lr *LessonReport) {
+	if e.done[lr] {
+		return
+	}
+	e.done[lr] = true
+	for _, b := range lr.AllBlocks() {
+		e.finishLocked(b)
+	}
+	for _, l := range e.listeners {
+		l.LessonFinished(lr)
+	}
+}
+
+// runFinished finishes every block and lesson not yet finished, then
+// announces the end of the run.
+func (e *eventSerializer) runFinished() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, lr := range e.report.Lessons() {
+		e.lessonFinishedLocked(lr)
+	}
+	for _, l := range e.listeners {
+		l.RunFinished(e.report)
+	}
+}
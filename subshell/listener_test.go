@@ -0,0 +1,83 @@
+package subshell
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/monopole/mdrip/base"
+	"github.com/monopole/mdrip/program"
+)
+
+func runWithListener(l Listener, blocks []*program.BlockPgm) *RunReport {
+	lesson := program.NewLessonPgm(base.FilePath("foo"), blocks)
+	p := program.NewProgram([]*program.LessonPgm{lesson})
+	return NewSubshell(timeout, p).AddListener(l).Run()
+}
+
+var listenerBlocks = []*program.BlockPgm{
+	makeBlock("echo kale\n"),
+	makeBlock("echo beans\nlochNessMonster\n"),
+	makeBlock("echo hasta\n")}
+
+func TestTapListener(t *testing.T) {
+	var out bytes.Buffer
+	runWithListener(NewTapListener(&out), listenerBlocks)
+	got := out.String()
+	for _, want := range []string{
+		"TAP version 13\n1..3\n",
+		"ok 1 - foo noNameBlock\n",
+		"not ok 2 - foo noNameBlock\n",
+		"  exitCode: 127\n",
+		"  stdout: |\n    beans\n",
+		"ok 3 - foo noNameBlock # SKIP\n",
+		"# foo: 1 passed, 1 failed, 1 skipped\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in\n%s", want, got)
+		}
+	}
+}
+
+func TestJsonLinesListener(t *testing.T) {
+	var out bytes.Buffer
+	// Relative order of stdout and stderr lines isn't deterministic,
+	// so use only one stream per block.
+	runWithListener(NewJsonLinesListener(&out), []*program.BlockPgm{
+		makeBlock("echo kale\n"),
+		makeBlock("lochNessMonster\n"),
+		makeBlock("echo hasta\n")})
+	events := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var e jsonEvent
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("bad json line %q: %v", line, err)
+		}
+		name := e.Event
+		if e.Event == "blockOutput" {
+			name += ":" + *e.Line
+		}
+		if e.Event == "blockFinished" {
+			name += ":" + e.Status
+		}
+		events = append(events, name)
+	}
+	want := []string{
+		"runStarted",
+		"blockStarted", "blockOutput:kale", "blockFinished:PASS",
+		"blockStarted", "lochNessMonster: command not found",
+		"blockFinished:FAIL",
+		"blockFinished:SKIP",
+		"lessonFinished",
+		"runFinished",
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got events\n%v\nwant\n%v", events, want)
+	}
+	for i := range want {
+		if !strings.HasSuffix(events[i], want[i]) {
+			t.Errorf("event %d: got %q, want %q", i, events[i], want[i])
+		}
+	}
+}
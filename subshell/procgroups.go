@@ -0,0 +1,135 @@
+package subshell
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/monopole/mdrip/util"
+)
+
+// killGrace is how long a process group has to exit after TERM
+// before getting KILL.
+const killGrace = 2 * time.Second
+
+// groupKill records the killing of one process group.
+type groupKill struct {
+	once      sync.Once
+	survivors []util.Process
+}
+
+// procGroups tracks the process groups of running shells, so that
+// each is killed at most once, and so that all of them can be killed
+// if mdrip is interrupted.
+type procGroups struct {
+	mu          sync.Mutex
+	groups      map[int]*groupKill
+	interrupted bool
+}
+
+func newProcGroups() *procGroups {
+	return &procGroups{groups: map[int]*groupKill{}}
+}
+
+// add starts tracking a group.  If mdrip has already been
+// interrupted, the group is killed right away.
+func (g *procGroups) add(pgid int) {
+	g.mu.Lock()
+	g.groups[pgid] = &groupKill{}
+	interrupted := g.interrupted
+	g.mu.Unlock()
+	if interrupted {
+		g.kill(pgid)
+	}
+}
+
+// remove stops tracking a group, as its id may be reused.
+func (g *procGroups) remove(pgid int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.groups, pgid)
+}
+
+// kill terminates every process in the group, unless that's already
+// been done, and returns the processes that were alive at the time,
+// less the group's leader (the shell itself).
+func (g *procGroups) kill(pgid int) []util.Process {
+	g.mu.Lock()
+	k := g.groups[pgid]
+	g.mu.Unlock()
+	if k == nil {
+		return nil
+	}
+	k.once.Do(func() {
+		for _, p := range util.KillProcessGroup(pgid, killGrace) {
+			if p.Pid != pgid {
+				k.survivors = append(k.survivors, p)
+			}
+		}
+	})
+	return k.survivors
+}
+
+// interrupt kills every tracked group, and arranges for groups added
+// later to be killed too.
+func (g *procGroups) interrupt() {
+	g.mu.Lock()
+	g.interrupted = true
+	pgids := []int{}
+	for pgid := range g.groups {
+		pgids = append(pgids, pgid)
+	}
+	g.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, pgid := range pgids {
+		wg.Add(1)
+		go func(pgid int) {
+			defer wg.Done()
+			g.kill(pgid)
+		}(pgid)
+	}
+	wg.Wait()
+}
+
+func (g *procGroups) isInterrupted() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.interrupted
+}
+
+// handleInterrupts kills all tracked groups on the first SIGINT or
+// SIGTERM, and exits on the second.  The returned func stops the
+// handling.
+func (g *procGroups) handleInterrupts() func() {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		if _, ok := <-ch; !ok {
+			return
+		}
+		glog.Warning("Interrupted; killing subprocesses.")
+		go g.interrupt()
+		if _, ok := <-ch; !ok {
+			return
+		}
+		os.Exit(130)
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(ch)
+	}
+}
+
+// describeKilled lists processes, one per line.
+func describeKilled(procs []util.Process) string {
+	var b strings.Builder
+	for _, p := range procs {
+		fmt.Fprintf(&b, "  %s\n", p)
+	}
+	return b.String()
+}
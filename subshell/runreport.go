@@ -0,0 +1,452 @@
+package subshell
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/monopole/mdrip/base"
+	"github.com/monopole/mdrip/program"
+	"github.com/monopole/mdrip/util"
+)
+
+// BlockStatus is the outcome of an attempt to run a command block.
+type BlockStatus int
+
+const (
+	// StatusSkipped means the block never ran, e.g. an earlier
+	// block failed and took the shell down with it.
+	StatusSkipped BlockStatus = iota
+	StatusPassed
+	StatusFailed
+	StatusTimedOut
+)
+
+func (s BlockStatus) String() string {
+	switch s {
+	case StatusSkipped:
+		return "SKIP"
+	case StatusPassed:
+		return "PASS"
+	case StatusFailed:
+		return "FAIL"
+	case StatusTimedOut:
+		return "TIMEOUT"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// BlockReport holds everything known about one run (or non-run)
+// of a command block.
+type BlockReport struct {
+	fileName base.FilePath     // File holding the block.
+	index    int               // Command block index in the file.
+	block    *program.BlockPgm // Content of actual command block.
+	status   BlockStatus
+	// completed is true if the block ran to the end without error,
+	// even if it then failed its expected output check.
+	completed bool
+	// bypassed is true if the block was skipped by its own skip-if
+	// command, rather than for want of a chance to run.
+	bypassed bool
+	exitCode int // Shell exit code; zero unless the block failed.
+	duration time.Duration
+	stdOut   string
+	stdErr   string
+	message  string // Why the block failed, if not obvious from stderr.
+	// killed lists the processes left running when the block failed,
+	// which mdrip then killed.
+	killed []util.Process
+}
+
+func NewBlockReport(
+	fileName base.FilePath, index int, block *program.BlockPgm) *BlockReport {
+	return &BlockReport{fileName, index, block, StatusSkipped, false, false, 0, 0, "", "", "", nil}
+}
+
+func (x *BlockReport) FileName() base.FilePath  { return x.fileName }
+func (x *BlockReport) Index() int               { return x.index }
+func (x *BlockReport) Block() *program.BlockPgm { return x.block }
+func (x *BlockReport) Name() string             { return x.block.Name() }
+
+// Where returns the block's file and line, e.g. "tutorial.md:42", or
+// just its file if the line isn't known.
+func (x *BlockReport) Where() string {
+	if l := x.block.Location(); l.Known() {
+		return l.InFile(x.fileName).String()
+	}
+	return string(x.fileName)
+}
+func (x *BlockReport) Status() BlockStatus     { return x.status }
+func (x *BlockReport) ExitCode() int           { return x.exitCode }
+func (x *BlockReport) Duration() time.Duration { return x.duration }
+func (x *BlockReport) StdOut() string          { return x.stdOut }
+func (x *BlockReport) StdErr() string          { return x.stdErr }
+func (x *BlockReport) Message() string         { return x.message }
+func (x *BlockReport) Killed() []util.Process  { return x.killed }
+
+// Completed is true if the block ran to the end and exited happily,
+// regardless of what it wrote.
+func (x *BlockReport) Completed() bool { return x.completed }
+
+// Bypassed is true if the block was skipped because its skip-if
+// command succeeded.  The blocks after it still got to run.
+func (x *BlockReport) Bypassed() bool { return x.bypassed }
+
+// Failed is true if the block ran and did not succeed.
+func (x *BlockReport) Failed() bool {
+	return x.status == StatusFailed || x.status == StatusTimedOut
+}
+
+func (x *BlockReport) SetStatus(s BlockStatus) *BlockReport {
+	x.status = s
+	x.completed = s == StatusPassed
+	return x
+}
+
+// SetBypassed marks the block skipped by its skip-if command.
+func (x *BlockReport) SetBypassed() *BlockReport {
+	x.SetStatus(StatusSkipped)
+	x.bypassed = true
+	x.message = fmt.Sprintf("skip-if %q succeeded", x.block.SkipIf())
+	return x
+}
+
+func (x *BlockReport) SetExitCode(c int) *BlockReport {
+	x.exitCode = c
+	return x
+}
+
+func (x *BlockReport) SetDuration(d time.Duration) *BlockReport {
+	x.duration = d
+	return x
+}
+
+func (x *BlockReport) SetStdOut(s string) *BlockReport {
+	x.stdOut = s
+	return x
+}
+
+func (x *BlockReport) SetStdErr(s string) *BlockReport {
+	x.stdErr = s
+	return x
+}
+
+func (x *BlockReport) SetMessage(m string) *BlockReport {
+	x.message = m
+	return x
+}
+
+func (x *BlockReport) SetKilled(p []util.Process) *BlockReport {
+	x.killed = p
+	return x
+}
+
+// checkExpected fails a passing block if its stdout doesn't match
+// the block's expected output.
+func (x *BlockReport) checkExpected() {
+	e := x.block.Expected()
+	if x.status != StatusPassed || e == nil {
+		return
+	}
+	if err := e.Match(x.stdOut); err != nil {
+		x.status = StatusFailed
+		x.message = fmt.Sprintf("%v (%s match)\n%s", err, e.Mode(),
+			util.UnifiedDiff("expected", "actual", e.Text(), x.stdOut))
+	}
+}
+
+// LessonReport holds a BlockReport for every block of a LessonPgm.
+// Cleanup blocks are kept apart from the rest, as they run apart.
+type LessonReport struct {
+	lesson   *program.LessonPgm
+	blocks   []*BlockReport
+	cleanups []*BlockReport
+}
+
+// NewLessonReport returns a report with every block marked skipped.
+// Blocks that can't be run say why.  The block holding only the prose
+// after the lesson's last fence isn't reported.
+func NewLessonReport(l *program.LessonPgm) *LessonReport {
+	var blocks, cleanups []*BlockReport
+	for i, b := range l.Blocks() {
+		if proseOnly(b) {
+			continue
+		}
+		br := NewBlockReport(l.Path(), l.Index(i), b)
+		if !b.Runnable() {
+			br.SetMessage(fmt.Sprintf("no interpreter for language %q", b.Language()))
+		}
+		if b.IsCleanup() {
+			cleanups = append(cleanups, br)
+		} else {
+			blocks = append(blocks, br)
+		}
+	}
+	return &LessonReport{l, blocks, cleanups}
+}
+
+// proseOnly is true of the block the lexer makes for the prose at the
+// end of a file, which came from no fence and has no code.
+func proseOnly(b *program.BlockPgm) bool {
+	return !b.Location().Known() && len(b.Code()) == 0
+}
+
+func (x *LessonReport) Lesson() *program.LessonPgm { return x.lesson }
+func (x *LessonReport) Path() base.FilePath        { return x.lesson.Path() }
+
+// Blocks returns the reports of the lesson's blocks, less its
+// cleanup blocks.
+func (x *LessonReport) Blocks() []*BlockReport { return x.blocks }
+
+// Cleanups returns the reports of the lesson's cleanup blocks.
+func (x *LessonReport) Cleanups() []*BlockReport { return x.cleanups }
+
+// AllBlocks returns Blocks followed by Cleanups.
+func (x *LessonReport) AllBlocks() []*BlockReport {
+	all := make([]*BlockReport, 0, len(x.blocks)+len(x.cleanups))
+	return append(append(all, x.blocks...), x.cleanups...)
+}
+
+// Count returns the number of blocks, cleanups included, with the
+// given status.
+func (x *LessonReport) Count(s BlockStatus) int {
+	n := 0
+	for _, b := range x.AllBlocks() {
+		if b.status == s {
+			n++
+		}
+	}
+	return n
+}
+
+// Duration is the time spent running the lesson's blocks.
+func (x *LessonReport) Duration() (d time.Duration) {
+	for _, b := range x.AllBlocks() {
+		d += b.duration
+	}
+	return
+}
+
+// RunReport holds a LessonReport for every lesson in a program.
+type RunReport struct {
+	label    base.Label
+	lessons  []*LessonReport
+	duration time.Duration
+	problem  error
+	// command is the command line that made the run, if known, for
+	// saying how to resume it.
+	command []string
+	// env holds the NAME=value settings the shells were given, and
+	// cleanEnv whether that was all they got, for rerunning the run
+	// as it was.
+	env      []string
+	cleanEnv bool
+}
+
+// NewRunReport returns a report with every block of every lesson
+// marked skipped.
+func NewRunReport(p *program.Program) *RunReport {
+	lessons := make([]*LessonReport, len(p.Lessons()))
+	for i, l := range p.Lessons() {
+		lessons[i] = NewLessonReport(l)
+	}
+	return &RunReport{p.Label(), lessons, 0, nil, nil, nil, false}
+}
+
+func (x *RunReport) Label() base.Label        { return x.label }
+func (x *RunReport) Lessons() []*LessonReport { return x.lessons }
+func (x *RunReport) Duration() time.Duration  { return x.duration }
+func (x *RunReport) Problem() error           { return x.problem }
+
+func (x *RunReport) SetDuration(d time.Duration) *RunReport {
+	x.duration = d
+	return x
+}
+
+func (x *RunReport) SetProblem(e error) *RunReport {
+	x.problem = e
+	return x
+}
+
+// SetCommand records the command line that made the run, e.g.
+// os.Args, so that Print can say how to resume the run if it fails.
+func (x *RunReport) SetCommand(args []string) *RunReport {
+	x.command = args
+	return x
+}
+
+// SetEnv records the environment settings the shells were given, and
+// whether they were given nothing else of mdrip's environment.
+func (x *RunReport) SetEnv(env []string, clean bool) *RunReport {
+	x.env, x.cleanEnv = env, clean
+	return x
+}
+
+// Env returns the environment settings the shells were given: in a
+// clean environment all they had, otherwise just those added to the
+// environment they inherited.
+func (x *RunReport) Env() []string { return x.env }
+
+// CleanEnv is true if the shells ran in a clean environment.
+func (x *RunReport) CleanEnv() bool { return x.cleanEnv }
+
+// ResumeFrom returns the block from which to resume the run, as
+// lesson:block for --from, or nothing if no block failed but
+// cleanup blocks.  The lesson is named by its path if another lesson
+// has the same name.
+func (x *RunReport) ResumeFrom() string {
+	names := map[string]int{}
+	for _, l := range x.lessons {
+		names[l.lesson.Name()]++
+	}
+	for _, l := range x.lessons {
+		for _, b := range l.blocks {
+			if !b.Failed() {
+				continue
+			}
+			lesson := l.lesson.Name()
+			if names[lesson] > 1 {
+				lesson = string(l.Path())
+			}
+			return fmt.Sprintf("%s:%d", lesson, b.index+1)
+		}
+	}
+	return ""
+}
+
+// ResumeCommand returns the command that resumes the run from the
+// block that failed, i.e. the command that made the run with --from
+// set to ResumeFrom, or nothing if there's no such block or the
+// command isn't known.
+func (x *RunReport) ResumeCommand() string {
+	from := x.ResumeFrom()
+	if len(x.command) == 0 || from == "" {
+		return ""
+	}
+	words := []string{shellWord(x.command[0]), "--from", shellWord(from)}
+	for i := 1; i < len(x.command); i++ {
+		switch a := x.command[i]; {
+		case a == "--from" || a == "-from":
+			i++ // Drop its value too.
+		case strings.HasPrefix(a, "--from=") || strings.HasPrefix(a, "-from="):
+		default:
+			words = append(words, shellWord(a))
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// plainWord matches words that need no quoting in a command line.
+var plainWord = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// shellWord returns s, quoted for bash if need be.
+func shellWord(s string) string {
+	if plainWord.MatchString(s) {
+		return s
+	}
+	return util.ShellQuote(s)
+}
+
+// Failures returns the reports of all blocks that failed.
+func (x *RunReport) Failures() (result []*BlockReport) {
+	for _, l := range x.lessons {
+		for _, b := range l.AllBlocks() {
+			if b.Failed() {
+				result = append(result, b)
+			}
+		}
+	}
+	return
+}
+
+// Count returns the number of blocks with the given status.
+func (x *RunReport) Count(s BlockStatus) int {
+	n := 0
+	for _, l := range x.lessons {
+		n += l.Count(s)
+	}
+	return n
+}
+
+// Print writes the environment given to the shells, if any, then a
+// line per block, with cleanup blocks listed after the rest, and the
+// blocks of each named session listed together, then the code and
+// captured output of every block that failed, then a summary, then
+// the command resuming the run, if known.
+func (x *RunReport) Print(w io.Writer) {
+	delim := strings.Repeat("-", 70) + "\n"
+	switch {
+	case x.cleanEnv:
+		fmt.Fprintf(w, "clean environment:\n")
+	case len(x.env) > 0:
+		fmt.Fprintf(w, "inherited environment, plus:\n")
+	}
+	for _, v := range x.env {
+		fmt.Fprintf(w, "  %s\n", v)
+	}
+	for _, l := range x.lessons {
+		fmt.Fprintf(w, "%s (%v)\n", l.Path(), l.Duration())
+		printSessions(w, "  ", l.blocks)
+		if len(l.cleanups) > 0 {
+			fmt.Fprintf(w, "  cleanup:\n")
+			printSessions(w, "    ", l.cleanups)
+		}
+	}
+	for _, b := range x.Failures() {
+		fmt.Fprint(w, delim)
+		b.block.Print(w, "Error", b.index+1, x.label, b.fileName)
+		fmt.Fprint(w, delim)
+		if len(b.message) > 0 {
+			printSection(w, "Problem", delim, b.message)
+		}
+		printSection(w, "Stdout capture", delim, b.stdOut)
+		if len(b.stdErr) > 0 {
+			printSection(w, "Stderr capture", delim, b.stdErr)
+		}
+		if len(b.killed) > 0 {
+			printSection(w, "Killed processes", delim, describeKilled(b.killed))
+		}
+	}
+	fmt.Fprintf(w, "%d passed, %d failed, %d timed out, %d skipped (%v)\n",
+		x.Count(StatusPassed), x.Count(StatusFailed),
+		x.Count(StatusTimedOut), x.Count(StatusSkipped), x.duration)
+	if c := x.ResumeCommand(); c != "" {
+		fmt.Fprintf(w, "To resume from the failed block:\n  %s\n", c)
+	}
+}
+
+// printSessions prints the lines of the blocks of the default
+// session, then those of each named session under its name.
+func printSessions(w io.Writer, indent string, blocks []*BlockReport) {
+	printBlockLines(w, indent, inSession(blocks, ""))
+	for _, session := range sessionsOf(blocks) {
+		if session == "" {
+			continue
+		}
+		fmt.Fprintf(w, "%ssession %s:\n", indent, session)
+		printBlockLines(w, indent+"  ", inSession(blocks, session))
+	}
+}
+
+func printBlockLines(w io.Writer, indent string, blocks []*BlockReport) {
+	for _, b := range blocks {
+		note := ""
+		if b.status == StatusSkipped && len(b.message) > 0 {
+			note = " - " + b.message
+		}
+		fmt.Fprintf(w, "%s%-7s %2d %s (%v)%s\n",
+			indent, b.status, b.index+1, b.Name(), b.duration, note)
+	}
+}
+
+func printSection(w io.Writer, title, delim, output string) {
+	fmt.Fprintf(w, "\n%s:\n", title)
+	fmt.Fprint(w, delim)
+	fmt.Fprint(w, output)
+	fmt.Fprint(w, "\n")
+	fmt.Fprint(w, delim)
+}
@@ -0,0 +1,178 @@
+package subshell
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/monopole/mdrip/program"
+	"github.com/monopole/mdrip/util"
+)
+
+// statusVar holds the exit status of a block run in a subshell.
+const statusVar = "__mdrip_status"
+
+// skippedStatus is reported in place of a block's exit status if its
+// skip-if command succeeded.  No real exit status is negative.
+const skippedStatus = -1
+
+// The shell is handed its status and ack pipes as fds 3 and 4, but
+// moves them out of the way of blocks that might use those.  Blocks
+// run with both closed, so that processes they leave running in the
+// background don't hold the pipes open.
+const (
+	statusFd = 8
+	ackFd    = 9
+	// closeFds is appended to a block to close the pipes while it runs.
+	closeFds = " 8>&- 9<&-"
+)
+
+// writeChannels writes the line that moves the pipes into place.
+func writeChannels(w io.Writer) {
+	write(w, fmt.Sprintf("exec %d>&3 %d<&4 3>&- 4<&-\n", statusFd, ackFd))
+}
+
+// saveStateFunc names the function that saves the shell's state.
+const saveStateFunc = "__mdrip_save_state"
+
+// writeScript writes the given blocks of a session, less those that
+// can't be run, as one script for "bash -e".
+//
+// If stateFile isn't empty, the script saves its variables, functions
+// and working directory to stateFile on exit, however it exits, so
+// that cleanup blocks can run in the same environment.
+func writeScript(w io.Writer, blocks []*BlockReport, stateFile string) {
+	writeChannels(w)
+	if len(stateFile) > 0 {
+		write(w, fmt.Sprintf(`%s() {
+  declare -p >'%s' 2>/dev/null
+  declare -f >>'%s'
+  printf 'cd %%q\n' "$PWD" >>'%s'
+}
+trap %s EXIT
+`, saveStateFunc, stateFile, stateFile, stateFile, saveStateFunc))
+	}
+	i := 0
+	for _, br := range blocks {
+		if !br.Block().Runnable() {
+			continue
+		}
+		writeBlock(w, i, br.Block())
+		i++
+	}
+}
+
+// writeCleanupScript writes the given cleanup blocks as one script
+// for plain "bash", after a line restoring the state saved by the
+// main script.  Each block runs in a subshell with -e, and the
+// script goes on to the next block whatever the outcome.
+func writeCleanupScript(w io.Writer, blocks []*BlockReport, stateFile string) {
+	writeChannels(w)
+	write(w, fmt.Sprintf("source '%s' 2>/dev/null\n", stateFile))
+	for i, br := range blocks {
+		var b strings.Builder
+		writeWait(&b)
+		skippable := writeSkipTest(&b, br.Block())
+		if skippable {
+			fmt.Fprintf(&b, "  %s=%d\nelse\n", statusVar, skippedStatus)
+		}
+		fmt.Fprintf(&b, "(\nset -e\n%s%s\n)%s\n%s=$?\n",
+			setup(br.Block()), br.Block().Body(), closeFds, statusVar)
+		if skippable {
+			fmt.Fprintf(&b, "fi\n")
+		}
+		writeStatus(&b, i, "$"+statusVar)
+		write(w, b.String())
+	}
+}
+
+// writeSkipTest writes the opening of an if statement whose
+// condition is the block's skip-if command, if it has one, and
+// returns whether it did.  The command's output is dropped, so as
+// not to be mistaken for the block's.
+func writeSkipTest(w io.Writer, block *program.BlockPgm) bool {
+	if block.SkipIf() == "" {
+		return false
+	}
+	fmt.Fprintf(w, "if (\n%s\n) >/dev/null 2>&1%s; then\n", block.SkipIf(), closeFds)
+	return true
+}
+
+// setup returns the lines that move a block to its directory and
+// set its variables, if it has any.  They're only for use in a
+// subshell, so as not to affect later blocks.
+func setup(block *program.BlockPgm) string {
+	var b strings.Builder
+	if d := block.Dir(); d != "" {
+		fmt.Fprintf(&b, "cd -- %s\n", util.ShellQuote(d))
+	}
+	for _, v := range block.Env() {
+		fmt.Fprintf(&b, "export %s\n", util.ShellQuote(v))
+	}
+	return b.String()
+}
+
+// writeBlock writes the block with the given index, preceded by a
+// line waiting to be told to go on, and followed by a line reporting
+// its exit status.
+//
+// A block expected to fail runs in a subshell with -e, so that it
+// stops at the first failing command just like any other block, but
+// without taking down the main shell.  Since it's a subshell, the
+// block can't alter the environment of later blocks.  If the block
+// exits with the wrong status, the main shell exits too.
+//
+// A block with its own directory or variables also runs in a
+// subshell, so that they don't leak into later blocks.  A block with
+// a skip-if command runs only if the command fails; otherwise it's
+// reported with skippedStatus.
+func writeBlock(out io.Writer, index int, block *program.BlockPgm) {
+	var w strings.Builder
+	writeWait(&w)
+	skippable := writeSkipTest(&w, block)
+	if skippable {
+		writeStatus(&w, index, strconv.Itoa(skippedStatus))
+		fmt.Fprintf(&w, "else\n")
+	}
+	switch n := block.ExpectedExit(); {
+	case n != 0:
+		fmt.Fprintf(&w, "set +e\n(\nset -e\n%s%s\n)%s\n%s=$?\n",
+			setup(block), block.Body(), closeFds, statusVar)
+		if n == program.ExitAnyFailure {
+			fmt.Fprintf(&w, "if [ $%s -eq 0 ]; then\n", statusVar)
+			fmt.Fprintf(&w, "  echo \"mdrip: expected failure, but block succeeded\" >&2\n")
+		} else {
+			fmt.Fprintf(&w, "if [ $%s -ne %d ]; then\n", statusVar, n)
+			fmt.Fprintf(&w, "  echo \"mdrip: expected exit status %d, got $%s\" >&2\n", n, statusVar)
+		}
+		fmt.Fprintf(&w, "  [ $%s -eq 0 ] && %s=1\n", statusVar, statusVar)
+		fmt.Fprintf(&w, "  exit $%s\nfi\nset -e\n", statusVar)
+		writeStatus(&w, index, "$"+statusVar)
+	case block.Confined():
+		fmt.Fprintf(&w, "(\nset -e\n%s%s\n)%s\n", setup(block), block.Body(), closeFds)
+		writeStatus(&w, index, "0")
+	default:
+		// A brace group, unlike a subshell, lets the block alter
+		// the environment of later blocks.  The ':' keeps the group
+		// from being empty, which bash won't allow.
+		fmt.Fprintf(&w, "{ :\n%s\n}%s\n", block.Body(), closeFds)
+		writeStatus(&w, index, "0")
+	}
+	if skippable {
+		fmt.Fprintf(&w, "fi\n")
+	}
+	write(out, w.String())
+}
+
+// writeWait writes the line waiting to be told to go on to the next
+// block.
+func writeWait(w io.Writer) {
+	fmt.Fprintf(w, "read -r -u %d __mdrip_ack || exit 1\n", ackFd)
+}
+
+// writeStatus writes the line reporting the exit status of the block
+// with the given index.
+func writeStatus(w io.Writer, index int, status string) {
+	fmt.Fprintf(w, "printf '%%d %%d\\n' %d %s >&%d\n", index, status, statusFd)
+}
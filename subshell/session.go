@@ -0,0 +1,111 @@
+package subshell
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/golang/glog"
+	"github.com/monopole/mdrip/util"
+)
+
+// A session is a shell that lives for the whole run, in which the
+// blocks naming it with session=name run, one at a time, interleaved
+// with the blocks of other sessions in document order.  Each session
+// has its own environment and working directory, so a tutorial can
+// start a server in one and talk to it from another.  Blocks naming
+// no session run in the default session, whose name is empty.
+
+// sessionsOf returns the names of the sessions the given blocks run
+// in, in order of first use.
+func sessionsOf(blocks []*BlockReport) []string {
+	seen := map[string]bool{}
+	result := []string{}
+	for _, b := range blocks {
+		if n := b.Block().Session(); !seen[n] {
+			seen[n] = true
+			result = append(result, n)
+		}
+	}
+	return result
+}
+
+// inSession returns the blocks that run in the given session.
+func inSession(blocks []*BlockReport, session string) []*BlockReport {
+	result := []*BlockReport{}
+	for _, b := range blocks {
+		if b.Block().Session() == session {
+			result = append(result, b)
+		}
+	}
+	return result
+}
+
+// shell is a running bash process, and mdrip's side of it.
+type shell struct {
+	session string
+	cmd     *exec.Cmd
+	pgid    int
+	script  string // The file holding the script it runs.
+	next    int    // The index in the script of the next block to run.
+	*shellIO
+}
+
+// startShell starts bash, with the given flags, in a new process
+// group and in the given directory, on a script written by writer.
+func (s *Subshell) startShell(
+	session, dir string, writer func(io.Writer), flags []string) *shell {
+	// Write program to a file to be executed.
+	tmpFile, err := ioutil.TempFile("", "mdrip-file-")
+	util.Check("create temp file", err)
+	util.Check("chmod temp file", os.Chmod(tmpFile.Name(), 0744))
+	writer(tmpFile)
+	util.Check("close temp file", tmpFile.Close())
+	if glog.V(2) {
+		glog.Infof("startShell: running session %q from %s", session, tmpFile.Name())
+	}
+
+	cmd := exec.Command("bash", append(flags, tmpFile.Name())...)
+	cmd.Dir = dir
+	cmd.Env = s.environ
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	out, errs := newStreamCapture(StreamStdOut), newStreamCapture(StreamStdErr)
+	cmd.Stdout, cmd.Stderr = out.file, errs.file
+
+	// The shell sees these as fds 3 and 4.
+	statusR, statusW, err := os.Pipe()
+	util.Check("status pipe", err)
+	ackR, ackW, err := os.Pipe()
+	util.Check("ack pipe", err)
+	cmd.ExtraFiles = []*os.File{statusW, ackR}
+
+	util.Check("shell start", cmd.Start())
+	util.Check("close status pipe", statusW.Close())
+	util.Check("close ack pipe", ackR.Close())
+
+	// With Setpgid, the shell leads its own process group.
+	pgid := cmd.Process.Pid
+	if glog.V(2) {
+		glog.Infof("startShell: pid = pgid = %d", pgid)
+	}
+	s.groups.add(pgid)
+	return &shell{session, cmd, pgid, tmpFile.Name(), 0,
+		&shellIO{out, errs, readStatus(statusR), ackW}}
+}
+
+// wait tells the shell there's nothing more to run, waits for it to
+// end, and cleans up after it.
+func (sh *shell) wait() error {
+	util.Check("close ack pipe", sh.ack.Close())
+	if glog.V(2) {
+		glog.Infof("wait: waiting for session %q to end.", sh.session)
+	}
+	err := sh.cmd.Wait()
+	sh.out.close()
+	sh.err.close()
+	util.Check("delete temp file", os.Remove(sh.script))
+	return err
+}
@@ -0,0 +1,67 @@
+package subshell
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// blockExit is what a shell reports on its status channel as each
+// block ends: the block's index in the script, and its exit status.
+type blockExit struct {
+	index int
+	code  int
+}
+
+// readStatus returns a channel carrying the block exits reported on
+// r.  The channel closes when r does, i.e. when the shell ends.
+func readStatus(r io.ReadCloser) <-chan blockExit {
+	ch := make(chan blockExit)
+	go func() {
+		defer close(ch)
+		defer r.Close()
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			fields := strings.Fields(s.Text())
+			if len(fields) != 2 {
+				glog.Errorf("bad status line %q", s.Text())
+				continue
+			}
+			index, err1 := strconv.Atoi(fields[0])
+			code, err2 := strconv.Atoi(fields[1])
+			if err1 != nil || err2 != nil {
+				glog.Errorf("bad status line %q", s.Text())
+				continue
+			}
+			ch <- blockExit{index, code}
+		}
+	}()
+	return ch
+}
+
+// shellIO is mdrip's side of a running shell: the shell's captured
+// output streams, the channel on which it reports each block's exit,
+// and the pipe on which it waits to be told to go on to the next
+// block.
+//
+// Since the shell waits before each block until told to go on,
+// nothing it writes in the meantime can be mistaken for output of
+// the next block, except output from processes it left running in
+// the background.
+type shellIO struct {
+	out    *streamCapture
+	err    *streamCapture
+	status <-chan blockExit
+	ack    io.WriteCloser
+}
+
+// goOn tells the shell to go on to the next block.
+func (x *shellIO) goOn() {
+	if _, err := fmt.Fprintln(x.ack); err != nil {
+		glog.Warningf("unable to tell shell to go on: %v", err)
+	}
+}
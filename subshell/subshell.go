@@ -1,18 +1,17 @@
 package subshell
 
 import (
-	"bytes"
-	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
 	"github.com/monopole/mdrip/program"
-	"github.com/monopole/mdrip/scanner"
 	"github.com/monopole/mdrip/util"
 )
 
@@ -20,84 +19,207 @@ import (
 type Subshell struct {
 	blockTimeout time.Duration
 	program      *program.Program
+	listeners    []Listener
+	keepGoing    bool
+	parallel     int
+	groups       *procGroups
+	runTimeout   time.Duration
+	deadline     time.Time // When the run must end, if runTimeout > 0.
+	env          []string  // NAME=value settings added to the shells' environment.
+	cleanEnv     bool
+	keepEnv      []string // What a clean environment keeps of mdrip's own.
+	environ      []string // The shells' environment, if not inherited as is.
 }
 
 func NewSubshell(timeout time.Duration, p *program.Program) *Subshell {
-	return &Subshell{timeout, p}
+	return &Subshell{
+		timeout, p, []Listener{}, false, 1, newProcGroups(), 0, time.Time{},
+		nil, false, nil, nil}
 }
 
+// SetKeepGoing arranges for each lesson to run in its own shell, so
+// that a failure in one lesson doesn't stop the others from running.
+func (s *Subshell) SetKeepGoing(k bool) *Subshell {
+	s.keepGoing = k
+	return s
+}
+
+// SetParallel arranges for up to n lessons to run at once, each in
+// its own shell and its own temporary working directory.
+func (s *Subshell) SetParallel(n int) *Subshell {
+	if n < 1 {
+		n = 1
+	}
+	s.parallel = n
+	return s
+}
+
+// SetRunTimeout limits the time the whole program may run.  Blocks
+// not done when time runs out are killed or skipped, though cleanup
+// blocks still run.  Zero means no limit.
+func (s *Subshell) SetRunTimeout(d time.Duration) *Subshell {
+	s.runTimeout = d
+	return s
+}
+
+// AddEnv adds NAME=value settings to the environment the shells run
+// in, each overriding mdrip's own value, and any earlier setting, of
+// the same variable.
+func (s *Subshell) AddEnv(settings ...string) *Subshell {
+	s.env = append(s.env, settings...)
+	return s
+}
+
+// SetCleanEnv arranges for the shells to run in an environment
+// holding just the named variables of mdrip's own, plus those added
+// with AddEnv, so that a run depends only on what it's given.
+func (s *Subshell) SetCleanEnv(keep []string) *Subshell {
+	s.cleanEnv, s.keepEnv = true, keep
+	return s
+}
+
+// AddListener arranges for the listener to hear about progress
+// during Run.
+func (s *Subshell) AddListener(l Listener) *Subshell {
+	s.listeners = append(s.listeners, l)
+	return s
+}
+
+// pollInterval is how often output is checked for new lines while a
+// block runs.
+const pollInterval = 100 * time.Millisecond
+
 // userBehavior acts like a command line user.
 //
-// TODO(monopole): update the comments, as this function no longer writes to stdin.
-// See https://github.com/monopole/mdrip/commit/a7be6a6fb62ccf8dfe1c2906515ce3e83d0400d7
+// It tells the shell of each block's session to go on to the block,
+// then waits to see if the block worked, recording the outcome and
+// captured output of the block in the report, and passing output
+// lines to listeners while the block runs.  If the block appeared to
+// complete without error, the routine moves on to the next block,
+// else it returns early, leaving the remaining blocks marked as
+// skipped.  A block whose skip-if command succeeded is marked as
+// skipped too, but doesn't stop the others.  The block that took
+// down its shell, if any, is returned.
 //
-// It writes command blocks to shell, then waits after each block to
-// see if the block worked.  If the block appeared to complete without
-// error, the routine sends the next block, else it exits early.
-func (s *Subshell) userBehavior(stdOut, stdErr io.ReadCloser) (errResult *RunResult) {
-
-	chOut := scanner.BuffScanner(s.blockTimeout, "stdout", stdOut)
-	chErr := scanner.BuffScanner(1*time.Minute, "stderr", stdErr)
+// A block that exits happily but fails to produce its expected
+// output is marked as failed, but doesn't stop the shell.  Likewise
+// a block that completes with an exit status it didn't expect, which
+// can only happen to a cleanup block.
+//
+// Each block gets a wall-clock deadline: the block's own timeout if
+// it has one, else the default blockTimeout, plus the time it may
+// spend waiting for its readiness conditions, cut short by the run's
+// deadline, if any, unless the block is a cleanup block.  A block
+// that misses its deadline is presumably still running, so kill is
+// called to stop it, and the shells, before reading its output.
+func (s *Subshell) userBehavior(
+	blocks []*BlockReport, events *eventSerializer,
+	shells map[string]*shell, kill func() []util.Process) *BlockReport {
 
-	chAccOut := accumulateOutput("stdOut", chOut)
-	chAccErr := accumulateOutput("stdErr", chErr)
+	for i, br := range blocks {
+		if !br.Block().Runnable() {
+			// Left out of the script; see writeScript.
+			events.blockFinished(br)
+			continue
+		}
+		sh := shells[br.Block().Session()]
+		glog.Infof("Running %s (%d/%d) from %s\n",
+			br.Name(), i+1, len(blocks), br.FileName())
+		if glog.V(2) {
+			glog.Infof("userBehavior: sending \"%s\"", br.Block().Code())
+		}
+		start := time.Now()
+		events.blockStarted(br)
+		onLine := func(s Stream, line string) {
+			events.blockOutput(br, s, line)
+		}
 
-	errResult = NewRunResult()
-	for _, lesson := range s.program.Lessons() {
-		numBlocks := len(lesson.Blocks())
-		for i, block := range lesson.Blocks() {
-			glog.Info("Running %s (%d/%d) from %s\n",
-				block.Name(), i+1, numBlocks, lesson.Path())
-			if glog.V(2) {
-				glog.Info("userBehavior: sending \"%s\"", block.Code())
+		sh.goOn()
+		limit, why := s.timeLimit(br)
+		timer := time.NewTimer(limit)
+		ticker := time.NewTicker(pollInterval)
+		var exit blockExit
+		reported, timedOut := false, false
+	wait:
+		for {
+			select {
+			case exit, reported = <-sh.status:
+				break wait
+			case <-ticker.C:
+				sh.out.poll(onLine)
+				sh.err.poll(onLine)
+			case <-timer.C:
+				timedOut = true
+				br.SetKilled(kill())
+				break wait
 			}
+		}
+		timer.Stop()
+		ticker.Stop()
+		br.SetDuration(time.Since(start))
+		br.SetStdOut(sh.out.cut(onLine)).SetStdErr(sh.err.cut(onLine))
 
-			result := <-chAccOut
-
-			if result == nil || !result.Succeeded() {
-				// A nil result means stdout has closed early because a
-				// sub-subprocess failed.
-				if result == nil {
-					if glog.V(2) {
-						glog.Info("userBehavior: stdout Result == nil.")
-					}
-					// Perhaps chErr <- scanner.MsgError +
-					//   " : early termination; stdout has closed."
-				} else {
-					if glog.V(2) {
-						glog.Info("userBehavior: stdout Result: %s", result.Output())
-					}
-					errResult.SetOutput(result.Output()).SetMessage(result.Output())
-				}
-				errResult.SetFileName(lesson.Path()).SetIndex(i).SetBlock(block)
-				fillErrResult(chAccErr, errResult)
-				return
+		switch {
+		case timedOut:
+			br.SetStatus(StatusTimedOut).SetMessage(
+				fmt.Sprintf("%s after %v", why, limit))
+			return br
+		case !reported:
+			// The shell ended without reporting the block's exit,
+			// presumably because the block failed under -e.
+			if glog.V(2) {
+				glog.Infof("userBehavior: session %q ended.", sh.session)
 			}
+			br.SetStatus(StatusFailed)
+			return br
+		case exit.index != sh.next:
+			br.SetStatus(StatusFailed).SetMessage(fmt.Sprintf(
+				"shell reported the end of block %d, expected block %d",
+				exit.index+1, sh.next+1))
+			return br
+		}
+		sh.next++
+		if exit.code == skippedStatus {
+			br.SetBypassed()
+			events.blockFinished(br)
+			continue
 		}
+		br.SetExitCode(exit.code)
+		if exit.code != 0 && br.Block().ExpectedExit() == 0 {
+			br.SetStatus(StatusFailed)
+		} else {
+			br.SetStatus(StatusPassed)
+			br.checkExpected()
+		}
+		events.blockFinished(br)
 	}
 	glog.Info("All done, no errors triggered.\n")
-	return
+	return nil
 }
 
-// fillErrResult fills an instance of RunResult.
-func fillErrResult(chAccErr <-chan *BlockOutput, errResult *RunResult) {
-	result := <-chAccErr
-	if result == nil {
-		if glog.V(2) {
-			glog.Info("userBehavior: stderr Result == nil.")
-		}
-		errResult.SetProblem(errors.New("unknown"))
-		return
+// timeLimit returns how long the block may run, and what to call
+// it if it runs longer.
+func (s *Subshell) timeLimit(br *BlockReport) (time.Duration, string) {
+	limit, why := s.blockTimeout, "block timed out"
+	if d := br.Block().Timeout(); d > 0 {
+		limit = d
 	}
-	errResult.SetProblem(errors.New(result.Output())).SetMessage(result.Output())
-	if glog.V(2) {
-		glog.Info("userBehavior: stderr Result: %s", result.Output())
+	limit += br.Block().WaitTime()
+	if s.runTimeout > 0 && !br.Block().IsCleanup() {
+		if left := time.Until(s.deadline); left < limit {
+			limit, why = left, fmt.Sprintf("run timed out (limit %v)", s.runTimeout)
+			if limit < 0 {
+				limit = 0
+			}
+		}
 	}
+	return limit, why
 }
 
-// RunInSubShell runs command blocks in a subprocess, stopping and
-// reporting on any error.  The subprocess runs with the -e flag, so
-// it will abort if any sub-subprocess (any command) fails.
+// Run runs command blocks in a subprocess, stopping on any error,
+// and returns a report covering every block.  The subprocess runs
+// with the -e flag, so it will abort if any sub-subprocess (any
+// command) fails.
 //
 // Command blocks are strings presumably holding code from some shell
 // language.  The strings may be more complex than single commands
@@ -109,70 +231,313 @@ func fillErrResult(chAccErr <-chan *BlockOutput, errResult *RunResult) {
 // if one line of text from a command block is an individual command
 // or part of something else.
 //
-// Error reporting works by discarding output from command blocks that
-// succeeded, and only reporting the contents of stdout and stderr
-// when the subprocess exits on error.
-func (s *Subshell) Run() (result *RunResult) {
-	// Write program to a file to be executed.
-	tmpFile, err := ioutil.TempFile("", "mdrip-file-")
-	util.Check("create temp file", err)
-	util.Check("chmod temp file", os.Chmod(tmpFile.Name(), 0744))
-	for _, lesson := range s.program.Lessons() {
-		for _, block := range lesson.Blocks() {
-			write(tmpFile, block.Code().String())
-			write(tmpFile, "\n")
-			write(tmpFile, "echo "+scanner.MsgHappy+" "+block.Name()+"\n")
+// After each block, the subprocess reports the block's exit status
+// on a dedicated file descriptor, then waits to be told to go on.
+// Meanwhile mdrip cuts the block's output from the files holding
+// the subprocess's stdout and stderr.  Blocks following a failure
+// are reported as skipped.  Listeners hear about each block as it
+// runs.
+//
+// Normally all lessons run in one subprocess, so a failure skips
+// all remaining blocks in all lessons.  In keepGoing mode, each
+// lesson gets its own subprocess, and a failure only skips the
+// remaining blocks of its own lesson.
+//
+// If parallel is more than one, lessons run concurrently, each in
+// its own subprocess.  A failure then stops new lessons from
+// starting (unless keepGoing is set), but doesn't interrupt lessons
+// already running.
+//
+// Blocks naming a session with session=name run in a subprocess of
+// their own, one per session, alongside the one running the other
+// blocks, so that each session keeps its own environment and working
+// directory.  Blocks still run one at a time, in order, whatever
+// their session, and a failure in any session skips all that follow.
+//
+// Cleanup blocks don't run with the others.  Once a subprocess ends,
+// for whatever reason, the cleanup blocks of every lesson it started
+// run in a second subprocess (one per session) that picks up the
+// variables, functions and working directory the first one ended
+// with.
+//
+// Each subprocess gets its own process group.  On a timeout, the
+// group is killed right away; otherwise whatever's left of it, e.g.
+// servers started in the background, is killed once the cleanup
+// blocks have run.  An interrupt (Ctrl-C) kills every group and
+// stops new lessons from starting; a second one exits at once.
+func (s *Subshell) Run() *RunReport {
+	report := NewRunReport(s.program)
+	events := newEventSerializer(s.listeners, report)
+	start := time.Now()
+	s.deadline = start.Add(s.runTimeout)
+	var recorded []string
+	s.environ, recorded = s.shellEnv()
+	report.SetEnv(recorded, s.cleanEnv)
+	stop := s.groups.handleInterrupts()
+	defer stop()
+	events.runStarted()
+
+	switch {
+	case s.parallel > 1:
+		report.SetProblem(s.runInParallel(report.Lessons(), events))
+	case s.keepGoing:
+		problems := []error{}
+		for _, l := range report.Lessons() {
+			if s.groups.isInterrupted() || s.outOfTime() {
+				break
+			}
+			if err := s.runLessons([]*LessonReport{l}, events, ""); err != nil {
+				problems = append(problems, err)
+			}
 		}
+		report.SetProblem(combineProblems(problems))
+	default:
+		report.SetProblem(s.runLessons(report.Lessons(), events, ""))
 	}
-	if glog.V(2) {
-		glog.Info("RunInSubShell: running commands from %s", tmpFile.Name())
-	}
-	defer func() {
-		util.Check("delete temp file", os.Remove(tmpFile.Name()))
-	}()
-
-	// Adding "-e" to force the subshell to die on any error.
-	shell := exec.Command("bash", "-e", tmpFile.Name())
 
-	stdIn, err := shell.StdinPipe()
-	util.Check("in pipe", err)
-	util.Check("close shell's stdin", stdIn.Close())
+	report.SetDuration(time.Since(start))
+	events.runFinished()
+	return report
+}
 
-	stdOut, err := shell.StdoutPipe()
-	util.Check("out pipe", err)
+// outOfTime is true if the run has a time limit, and it has passed.
+func (s *Subshell) outOfTime() bool {
+	return s.runTimeout > 0 && time.Now().After(s.deadline)
+}
 
-	stdErr, err := shell.StderrPipe()
-	util.Check("err pipe", err)
+// runInParallel runs each lesson in its own subprocess and temporary
+// working directory, with at most s.parallel subprocesses at once.
+// Problems are reported in lesson order, regardless of the order in
+// which lessons finish.
+func (s *Subshell) runInParallel(
+	lessons []*LessonReport, events *eventSerializer) error {
+	problems := make([]error, len(lessons))
+	var mu sync.Mutex
+	failed := false
+	slots := make(chan bool, s.parallel)
+	var wg sync.WaitGroup
+	for i, l := range lessons {
+		slots <- true
+		mu.Lock()
+		stop := failed && !s.keepGoing || s.groups.isInterrupted() || s.outOfTime()
+		mu.Unlock()
+		if stop {
+			<-slots
+			break
+		}
+		wg.Add(1)
+		go func(i int, l *LessonReport) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			dir, err := ioutil.TempDir("", "mdrip-lesson-")
+			util.Check("create lesson dir", err)
+			defer os.RemoveAll(dir)
+			if err := s.runLessons([]*LessonReport{l}, events, dir); err != nil {
+				mu.Lock()
+				problems[i] = err
+				failed = true
+				mu.Unlock()
+			}
+		}(i, l)
+	}
+	wg.Wait()
+	result := []error{}
+	for _, p := range problems {
+		if p != nil {
+			result = append(result, p)
+		}
+	}
+	return combineProblems(result)
+}
 
-	err = shell.Start()
-	util.Check("shell start", err)
+// runLessons runs the given lessons in one set of sessions, then
+// runs the cleanup blocks of the lessons it got to in another,
+// filling in their reports.  It returns an error describing the
+// first failing block, if any.  The sessions run in the given
+// directory, or in the current directory if dir is empty.
+func (s *Subshell) runLessons(
+	lessons []*LessonReport, events *eventSerializer, dir string) error {
+	blocks := []*BlockReport{}
+	all := []*BlockReport{}
+	for _, l := range lessons {
+		blocks = append(blocks, l.Blocks()...)
+		all = append(all, l.AllBlocks()...)
+	}
+	stateFiles := map[string]string{}
+	if hasCleanups(lessons) {
+		for _, session := range sessionsOf(all) {
+			f, err := ioutil.TempFile("", "mdrip-state-")
+			util.Check("create state file", err)
+			util.Check("close state file", f.Close())
+			stateFiles[session] = f.Name()
+		}
+		defer func() {
+			for _, f := range stateFiles {
+				util.Check("delete state file", os.Remove(f))
+			}
+		}()
+	}
+	// Adding "-e" to force the subshell to die on any error.
+	fatal, pgids, waitError := s.runSessions(blocks, events, dir,
+		func(w io.Writer, session string, blocks []*BlockReport) {
+			writeScript(w, blocks, stateFiles[session])
+		}, "-e")
+	if fatal != nil {
+		if exitErr, ok := waitError.(*exec.ExitError); ok {
+			fatal.SetExitCode(exitErr.ExitCode())
+		}
+		if s.groups.isInterrupted() && len(fatal.Message()) == 0 {
+			fatal.SetMessage("interrupted")
+		}
+		events.blockFinished(fatal)
+	}
+	if cleanups := cleanupsToRun(lessons); len(cleanups) > 0 {
+		cFatal, cPgids, _ := s.runSessions(cleanups, events, dir,
+			func(w io.Writer, session string, blocks []*BlockReport) {
+				writeCleanupScript(w, blocks, stateFiles[session])
+			})
+		s.stopGroups(cPgids, cFatal)
+	}
+	s.stopGroups(pgids, fatal)
+	for _, l := range lessons {
+		for _, b := range l.AllBlocks() {
+			if b.Failed() {
+				return problemFor(b, waitError)
+			}
+		}
+	}
+	return waitError
+}
 
-	pid := shell.Process.Pid
-	if glog.V(2) {
-		glog.Info("RunInSubShell: pid = %d", pid)
+// hasCleanups is true if any of the lessons has a cleanup block.
+func hasCleanups(lessons []*LessonReport) bool {
+	for _, l := range lessons {
+		if len(l.Cleanups()) > 0 {
+			return true
+		}
 	}
-	pgid, err := util.GetProcesssGroupId(pid)
-	if err == nil {
-		if glog.V(2) {
-			glog.Info("RunInSubShell:  pgid = %d", pgid)
+	return false
+}
+
+// cleanupsToRun returns the runnable cleanup blocks of the lessons
+// that the sessions got to, i.e. every lesson up to and including
+// the one holding the block that took down a shell.  Lessons are
+// cleaned up in reverse order, the blocks of each lesson in document
+// order.
+func cleanupsToRun(lessons []*LessonReport) []*BlockReport {
+	result := []*BlockReport{}
+	for _, l := range lessons {
+		cleanups := []*BlockReport{}
+		for _, b := range l.Cleanups() {
+			if b.Block().Runnable() {
+				cleanups = append(cleanups, b)
+			}
+		}
+		result = append(cleanups, result...)
+		for _, b := range l.Blocks() {
+			if b.Block().Runnable() && !b.Completed() && !b.Bypassed() {
+				return result
+			}
 		}
 	}
+	return result
+}
 
-	result = s.userBehavior(stdOut, stdErr)
+// stopGroups kills whatever is left of the process groups of a set
+// of sessions, noting the processes it killed in the report of the
+// block that took down a shell, if any.
+func (s *Subshell) stopGroups(pgids []int, fatal *BlockReport) {
+	killed := []util.Process{}
+	for _, pgid := range pgids {
+		killed = append(killed, s.groups.kill(pgid)...)
+		s.groups.remove(pgid)
+	}
+	if len(killed) == 0 {
+		return
+	}
+	if fatal != nil {
+		fatal.SetKilled(killed)
+		return
+	}
+	glog.Warningf("Killed processes left running by a shell:\n%s",
+		describeKilled(killed))
+}
 
-	if glog.V(2) {
-		glog.Info("RunInSubShell:  Waiting for shell to end.")
+// runSessions runs a shell for each session of the given blocks,
+// with the given flags, each on a script holding the session's
+// blocks as written by writer.  The shells run side by side, each
+// block running when its turn comes.  It returns the block that took
+// down its shell, if any, the process group ids of the shells, and
+// the error from waiting for the shell of that block, or else for
+// the first shell that failed.
+//
+// However they end, the shells are all gone by the time this returns,
+// but processes they left running in the background aren't.
+func (s *Subshell) runSessions(
+	blocks []*BlockReport, events *eventSerializer, dir string,
+	writer func(w io.Writer, session string, blocks []*BlockReport),
+	flags ...string) (*BlockReport, []int, error) {
+	sessions := sessionsOf(blocks)
+	shells := map[string]*shell{}
+	pgids := []int{}
+	for _, session := range sessions {
+		mine := inSession(blocks, session)
+		shells[session] = s.startShell(session, dir,
+			func(w io.Writer) { writer(w, session, mine) }, flags)
+		pgids = append(pgids, shells[session].pgid)
 	}
-	waitError := shell.Wait()
-	if result.Problem() == nil {
-		result.SetProblem(waitError)
+	fatal := s.userBehavior(blocks, events, shells, func() []util.Process {
+		killed := []util.Process{}
+		for _, pgid := range pgids {
+			killed = append(killed, s.groups.kill(pgid)...)
+		}
+		return killed
+	})
+	var waitError error
+	for _, session := range sessions {
+		err := shells[session].wait()
+		if fatal != nil && session == fatal.Block().Session() ||
+			fatal == nil && waitError == nil {
+			waitError = err
+		}
 	}
 	if glog.V(2) {
-		glog.Info("RunInSubShell:  Shell done.")
+		glog.Info("runSessions: shells done.")
 	}
+	return fatal, pgids, waitError
+}
 
-	// killProcesssGroup(pgid)
-	return
+// combineProblems returns nil, the only problem, or a problem
+// listing all the problems.
+func combineProblems(problems []error) error {
+	switch len(problems) {
+	case 0:
+		return nil
+	case 1:
+		return problems[0]
+	}
+	msgs := make([]string, len(problems))
+	for i, p := range problems {
+		msgs[i] = p.Error()
+	}
+	return fmt.Errorf("%d lessons failed:\n%s",
+		len(problems), strings.Join(msgs, "\n"))
+}
+
+// problemFor summarizes a failed block as an error.
+func problemFor(b *BlockReport, waitError error) error {
+	detail := strings.TrimSpace(b.Message())
+	if len(detail) == 0 {
+		detail = strings.TrimSpace(b.StdErr())
+	}
+	if len(detail) == 0 && waitError != nil {
+		detail = waitError.Error()
+	}
+	if len(detail) == 0 {
+		detail = "unknown"
+	}
+	return fmt.Errorf("%s: block %d (%s) at %s: %s",
+		b.Status(), b.Index()+1, b.Name(), b.Where(), detail)
 }
 
 func write(writer io.Writer, output string) {
@@ -184,74 +549,3 @@ func write(writer io.Writer, output string) {
 		glog.Fatalf("Expected to write %d bytes, wrote %d", len(output), n)
 	}
 }
-
-// accumulateOutput returns a channel to which it writes objects that
-// contain what purport to be the entire output of one command block.
-//
-// To do so, it accumulates strings off a channel representing command
-// block output until the channel closes, or until a string arrives
-// that matches a particular pattern.
-//
-// On the happy path, strings are accumulated and every so often sent
-// out with a success == true flag attached.  This continues until the
-// input channel closes.
-//
-// On a sad path, an accumulation of strings is sent with a success ==
-// false flag attached, and the function exits early, before it's
-// input channel closes.
-func accumulateOutput(prefix string, in <-chan string) <-chan *BlockOutput {
-	out := make(chan *BlockOutput)
-	var accum bytes.Buffer
-	go func() {
-		defer close(out)
-		for line := range in {
-			if strings.HasPrefix(line, scanner.MsgTimeout) {
-				accum.WriteString("\n" + line + "\n")
-				accum.WriteString("A subprocess might still be running.\n")
-				if glog.V(2) {
-					glog.Info("accumulateOutput %s: Timeout return.", prefix)
-				}
-				out <- NewFailureOutput(accum.String())
-				return
-			}
-			if strings.HasPrefix(line, scanner.MsgError) {
-				accum.WriteString(line + "\n")
-				if glog.V(2) {
-					glog.Info("accumulateOutput %s: Error return.", prefix)
-				}
-				out <- NewFailureOutput(accum.String())
-				return
-			}
-			if strings.HasPrefix(line, scanner.MsgHappy) {
-				if glog.V(2) {
-					glog.Info("accumulateOutput %s: %s", prefix, line)
-				}
-				out <- NewSuccessOutput(accum.String())
-				accum.Reset()
-			} else {
-				if glog.V(2) {
-					glog.Info("accumulateOutput %s: Accumulating [%s]", prefix, line)
-				}
-				accum.WriteString(line + "\n")
-			}
-		}
-
-		if glog.V(2) {
-			glog.Info("accumulateOutput %s: <--- This channel has closed.", prefix)
-		}
-		trailing := strings.TrimSpace(accum.String())
-		if len(trailing) > 0 {
-			if glog.V(2) {
-				glog.Info(
-					"accumulateOutput %s: Erroneous (missing-happy) output [%s]",
-					prefix, accum.String())
-			}
-			out <- NewFailureOutput(accum.String())
-		} else {
-			if glog.V(2) {
-				glog.Info("accumulateOutput %s: Nothing trailing.", prefix)
-			}
-		}
-	}()
-	return out
-}
@@ -1,14 +1,19 @@
 package subshell
 
 import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/monopole/mdrip/base"
+	"github.com/monopole/mdrip/lexer"
 	"github.com/monopole/mdrip/model"
 	"github.com/monopole/mdrip/program"
-	"github.com/monopole/mdrip/scanner"
 )
 
 const timeout = 2 * time.Second
@@ -33,7 +38,7 @@ func TestRunnerWithNothing(t *testing.T) {
 	}
 }
 
-func doIt(blocks []*program.BlockPgm) *RunResult {
+func doIt(blocks []*program.BlockPgm) *RunReport {
 	lesson := program.NewLessonPgm(base.FilePath("foo"), blocks)
 	p := program.NewProgram([]*program.LessonPgm{lesson})
 	return NewSubshell(timeout, p).Run()
@@ -42,62 +47,80 @@ func doIt(blocks []*program.BlockPgm) *RunResult {
 func TestRunnerWithGoodStuff(t *testing.T) {
 	blocks := []*program.BlockPgm{
 		makeBlock("echo kale\ndate\n"),
-		makeBlock("echo beans\necho apple\n"),
+		makeBlock("echo beans\necho apple >&2\n"),
 		makeBlock("echo hasta\necho la vista\n")}
-	result := doIt(blocks)
-	if result.Problem() != nil {
+	report := doIt(blocks)
+	if report.Problem() != nil {
 		t.Fail()
 	}
+	if n := report.Count(StatusPassed); n != 3 {
+		t.Errorf("expected 3 passing blocks, got %d", n)
+	}
+	b := report.Lessons()[0].Blocks()[1]
+	if b.StdOut() != "beans\n" {
+		t.Errorf("stdout got %q", b.StdOut())
+	}
+	if b.StdErr() != "apple\n" {
+		t.Errorf("stderr got %q", b.StdErr())
+	}
 }
 
-func checkFail(t *testing.T, got, want *RunResult) {
+// checkFail confirms that the block at index failed with the given
+// status and a message on stderr, and that all subsequent blocks
+// were skipped.
+func checkFail(
+	t *testing.T, got *RunReport, index int, status BlockStatus, message string) {
 	if got.Problem() == nil {
 		t.Fail()
 	}
-	if got.Index() != want.Index() {
-		t.Errorf("%s got\n\t%v\nwant\n\t%v", "file", got.Index(), want.Index())
+	failures := got.Failures()
+	if len(failures) != 1 {
+		t.Fatalf("expected one failure, got %d", len(failures))
+	}
+	f := failures[0]
+	if f.Index() != index {
+		t.Errorf("%s got\n\t%v\nwant\n\t%v", "index", f.Index(), index)
+	}
+	if f.Status() != status {
+		t.Errorf("%s got\n\t%v\nwant\n\t%v", "status", f.Status(), status)
 	}
-	if !strings.Contains(got.Message(), want.Message()) {
-		t.Errorf("%s got\n\t\"%v\"\nwant\n\t%v", "message", got.Message(), want.Message())
+	if !strings.Contains(f.Message()+f.StdOut()+f.StdErr(), message) {
+		t.Errorf("%s got\n\t\"%v\"\nwant\n\t%v", "message", f.StdErr(), message)
+	}
+	blocks := got.Lessons()[0].Blocks()
+	for i, b := range blocks {
+		switch {
+		case i < index && b.Status() != StatusPassed:
+			t.Errorf("block %d should have passed, got %v", i, b.Status())
+		case i > index && b.Status() != StatusSkipped:
+			t.Errorf("block %d should be skipped, got %v", i, b.Status())
+		}
 	}
 }
 
 func TestStartWithABadCommand(t *testing.T) {
-	want := NoCommandsRunResult(
-		NewFailureOutput("dunno"),
-		"fileNameTestStartWithABadCommand",
-		0,
-		"line 1: notagoodcommand: command not found")
-
 	blocks := []*program.BlockPgm{
 		makeBlock("notagoodcommand\ndate\n"),
 		makeBlock("echo beans\necho cheese\n")}
-	checkFail(t, doIt(blocks), want)
+	report := doIt(blocks)
+	checkFail(t, report, 0, StatusFailed,
+		"line 4: notagoodcommand: command not found")
+	if c := report.Failures()[0].ExitCode(); c != 127 {
+		t.Errorf("expected exit code 127, got %d", c)
+	}
 }
 
 func TestBadCommandInTheMiddle(t *testing.T) {
-	want := NoCommandsRunResult(
-		NewFailureOutput("dunno"),
-		"fileNameTestBadCommandInTheMiddle",
-		2,
-		"line 9: lochNessMonster: command not found")
-
 	blocks := []*program.BlockPgm{
 		makeBlock("echo tofu\ndate\n"),
 		makeBlock("echo beans\necho kale\n"),
 		makeBlock("lochNessMonster\n"),
 		makeBlock("echo hasta\necho la vista\n")}
-
-	checkFail(t, doIt(blocks), want)
+	checkFail(t, doIt(blocks), 2, StatusFailed,
+		"lochNessMonster: command not found")
 }
 
 func TestTimeOut(t *testing.T) {
-	want := NoCommandsRunResult(
-		NewFailureOutput("dunno"),
-		"fileNameTestTimeOut",
-		0,
-		scanner.MsgTimeout)
-
 	// Insert this sleep in a command block.
 	// Arrange to sleep for two seconds longer than the timeout.
 	sleep := timeout + (2 * time.Second)
@@ -105,5 +128,607 @@ func TestTimeOut(t *testing.T) {
 	blocks := []*program.BlockPgm{
 		makeBlock("date\nsleep " + sleep.String() + "\necho kale"),
 		makeBlock("echo beans\necho cheese\n")}
-	checkFail(t, doIt(blocks), want)
+	checkFail(t, doIt(blocks), 0, StatusTimedOut, "block timed out after 2s")
+}
+
+func twoLessonProgram() *program.Program {
+	return program.NewProgram([]*program.LessonPgm{
+		program.NewLessonPgm(base.FilePath("bad"), []*program.BlockPgm{
+			makeBlock("echo tofu\n"),
+			makeBlock("lochNessMonster\n"),
+			makeBlock("echo kale\n")}),
+		program.NewLessonPgm(base.FilePath("good"), []*program.BlockPgm{
+			makeBlock("echo hasta\n"),
+			makeBlock("echo la vista\n")})})
+}
+
+func TestFailureSkipsLaterLessons(t *testing.T) {
+	report := NewSubshell(timeout, twoLessonProgram()).Run()
+	if report.Problem() == nil {
+		t.Errorf("expected a problem")
+	}
+	if n := report.Lessons()[1].Count(StatusSkipped); n != 2 {
+		t.Errorf("expected second lesson skipped, got %d skipped", n)
+	}
+}
+
+func TestKeepGoing(t *testing.T) {
+	report := NewSubshell(timeout, twoLessonProgram()).SetKeepGoing(true).Run()
+	if report.Problem() == nil {
+		t.Errorf("expected a problem")
+	}
+	bad := report.Lessons()[0]
+	if bad.Count(StatusFailed) != 1 || bad.Count(StatusSkipped) != 1 {
+		t.Errorf("first lesson should have one failure and one skip")
+	}
+	if n := report.Lessons()[1].Count(StatusPassed); n != 2 {
+		t.Errorf("expected second lesson to pass, got %d passed", n)
+	}
+}
+
+func TestParallel(t *testing.T) {
+	lessons := []*program.LessonPgm{}
+	for _, n := range []string{"a", "b", "c"} {
+		lessons = append(lessons, program.NewLessonPgm(base.FilePath(n),
+			[]*program.BlockPgm{
+				makeBlock("sleep 1\n"),
+				makeBlock("echo " + n + " > f\ncat f\npwd\n")}))
+	}
+	start := time.Now()
+	report := NewSubshell(timeout, program.NewProgram(lessons)).SetParallel(3).Run()
+	if report.Problem() != nil {
+		t.Fatalf("unexpected problem: %v", report.Problem())
+	}
+	if d := time.Since(start); d > 2500*time.Millisecond {
+		t.Errorf("lessons apparently didn't run in parallel, took %v", d)
+	}
+	dirs := map[string]bool{}
+	for i, l := range report.Lessons() {
+		if l.Lesson() != lessons[i] {
+			t.Errorf("lesson %d out of order", i)
+		}
+		out := strings.Split(l.Blocks()[1].StdOut(), "\n")
+		if out[0] != string(lessons[i].Path()) {
+			t.Errorf("lesson %d: got output %q", i, out[0])
+		}
+		dirs[out[1]] = true
+	}
+	if len(dirs) != 3 {
+		t.Errorf("expected distinct working directories, got %v", dirs)
+	}
+}
+
+func TestExpectedOutput(t *testing.T) {
+	blocks := []*program.BlockPgm{
+		makeBlock("echo kale\n").SetExpected(
+			base.NewExpectedOutput(base.MatchExact, "kale\n")),
+		makeBlock("echo beans\necho cheese\n").SetExpected(
+			base.NewExpectedOutput(base.MatchExact, "beans\nrice\n")),
+		makeBlock("date\n").SetExpected(
+			base.NewExpectedOutput(base.MatchRegexp, "[0-9]+")),
+		makeBlock("echo hasta la vista\n").SetExpected(
+			base.NewExpectedOutput(base.MatchContains, "la vista"))}
+	report := doIt(blocks)
+	if report.Problem() == nil {
+		t.Fatalf("expected a problem")
+	}
+	got := report.Lessons()[0].Blocks()
+	want := []BlockStatus{StatusPassed, StatusFailed, StatusPassed, StatusPassed}
+	for i, b := range got {
+		if b.Status() != want[i] {
+			t.Errorf("block %d: got %v, want %v", i, b.Status(), want[i])
+		}
+	}
+	if !strings.Contains(got[1].Message(), "-rice\n+cheese\n") {
+		t.Errorf("expected a diff, got %q", got[1].Message())
+	}
+}
+
+func TestExpectedFailures(t *testing.T) {
+	blocks := []*program.BlockPgm{
+		makeBlock("export KALE=1\n"),
+		makeBlock("echo beans\nlochNessMonster\necho unreached\n").
+			SetExpectedExit(program.ExitAnyFailure),
+		makeBlock("exit 3\n").SetExpectedExit(3),
+		makeBlock("echo $KALE\n"),
+		makeBlock("exit 4\n").SetExpectedExit(3),
+		makeBlock("echo skipped\n")}
+	report := doIt(blocks)
+	got := report.Lessons()[0].Blocks()
+	want := []BlockStatus{
+		StatusPassed, StatusPassed, StatusPassed,
+		StatusPassed, StatusFailed, StatusSkipped}
+	for i, b := range got {
+		if b.Status() != want[i] {
+			t.Errorf("block %d: got %v, want %v", i, b.Status(), want[i])
+		}
+	}
+	if got[1].StdOut() != "beans\n" {
+		t.Errorf("expected failing block to stop at failure, got %q", got[1].StdOut())
+	}
+	if got[3].StdOut() != "1\n" {
+		t.Errorf("expected shell to survive, got %q", got[3].StdOut())
+	}
+	if !strings.Contains(got[4].StdErr(), "expected exit status 3, got 4") {
+		t.Errorf("unexpected stderr %q", got[4].StdErr())
+	}
+	if got[4].ExitCode() != 4 {
+		t.Errorf("expected exit code 4, got %d", got[4].ExitCode())
+	}
+}
+
+func TestBlockAttributes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdrip-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blocks := []*program.BlockPgm{
+		makeBlock("export KALE=1\n"),
+		makeBlock("pwd\necho $KALE $BEANS\n").
+			SetDir(dir).SetEnv([]string{"BEANS=it's beans", "KALE=2"}),
+		makeBlock("echo $KALE $BEANS\n"),
+		makeBlock("echo skipped\n").SetSkipIf("true"),
+		makeBlock("echo ran\n").SetSkipIf("false"),
+		makeBlock("echo $BEANS\nexit 3\n").
+			SetEnv([]string{"BEANS=b"}).SetExpectedExit(3),
+		makeBlock("echo skipped\n").SetSkipIf("test -d " + dir).SetCleanup(true),
+		makeBlock("lochNessMonster\n").SetDir(dir + "/nowhere"),
+		makeBlock("echo unreached\n").SetSkipIf("true")}
+	report := doIt(blocks)
+	l := report.Lessons()[0]
+	got := l.Blocks()
+	want := []struct {
+		status   BlockStatus
+		bypassed bool
+		out      string
+	}{
+		{StatusPassed, false, ""},
+		{StatusPassed, false, dir + "\n2 it's beans\n"},
+		{StatusPassed, false, "1\n"},
+		{StatusSkipped, true, ""},
+		{StatusPassed, false, "ran\n"},
+		{StatusPassed, false, "b\n"},
+		{StatusFailed, false, ""},
+		{StatusSkipped, false, ""},
+	}
+	for i, b := range got {
+		w := want[i]
+		if b.Status() != w.status || b.Bypassed() != w.bypassed || b.StdOut() != w.out {
+			t.Errorf("block %d: got %v %v %q, want %v %v %q", i,
+				b.Status(), b.Bypassed(), b.StdOut(), w.status, w.bypassed, w.out)
+		}
+	}
+	if m := got[3].Message(); m != `skip-if "true" succeeded` {
+		t.Errorf("unexpected message %q", m)
+	}
+	if !strings.Contains(got[6].StdErr(), "nowhere") {
+		t.Errorf("unexpected stderr %q", got[6].StdErr())
+	}
+	if c := l.Cleanups()[0]; !c.Bypassed() {
+		t.Errorf("expected cleanup skipped, got %v", c.Status())
+	}
+}
+
+func TestResumeCommand(t *testing.T) {
+	lessons := []*program.LessonPgm{
+		program.NewLessonPgm(base.FilePath("x/a.md"), []*program.BlockPgm{
+			makeBlock("echo a\n")}),
+		program.NewLessonPgm(base.FilePath("y/a.md"), []*program.BlockPgm{
+			makeBlock("echo a\n"),
+			makeBlock("lochNessMonster\n")})}
+	report := NewSubshell(timeout, program.NewProgram(lessons)).Run()
+	if got := report.ResumeCommand(); got != "" {
+		t.Errorf("expected no command without a command line, got %q", got)
+	}
+	report.SetCommand([]string{"mdrip", "--mode", "test", "--from=a:1", "--label", "a b", "x/a.md", "y/a.md"})
+	want := "mdrip --from y/a.md:2 --mode test --label 'a b' x/a.md y/a.md"
+	if got := report.ResumeCommand(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	var b strings.Builder
+	report.Print(&b)
+	if !strings.HasSuffix(b.String(), "To resume from the failed block:\n  "+want+"\n") {
+		t.Errorf("unexpected report\n%s", b.String())
+	}
+}
+
+func TestSessions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdrip-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blocks := []*program.BlockPgm{
+		makeBlock("export A=1\ncd " + dir + "\n"),
+		makeBlock("export B=2\ncd /\nsleep 98 >/dev/null 2>&1 &\necho $! >" + dir + "/pid\n").
+			SetSession("server"),
+		makeBlock("echo $A $B\npwd\n"),
+		makeBlock("echo $A $B\npwd\n").SetSession("server"),
+		makeBlock("echo $B\n").SetSession("server").SetCleanup(true),
+		makeBlock("echo $A\n").SetCleanup(true),
+		makeBlock("lochNessMonster\n").SetSession("client"),
+		makeBlock("echo unreached\n").SetSession("server")}
+	report := doIt(blocks)
+	l := report.Lessons()[0]
+	want := []struct {
+		status BlockStatus
+		out    string
+	}{
+		{StatusPassed, ""},
+		{StatusPassed, ""},
+		{StatusPassed, "1\n" + dir + "\n"},
+		{StatusPassed, "2\n/\n"},
+		{StatusFailed, ""},
+		{StatusSkipped, ""},
+		{StatusPassed, "2\n"},
+		{StatusPassed, "1\n"},
+	}
+	for i, b := range l.AllBlocks() {
+		if b.Status() != want[i].status || b.StdOut() != want[i].out {
+			t.Errorf("block %d: got %v %q, want %v %q",
+				i, b.Status(), b.StdOut(), want[i].status, want[i].out)
+		}
+	}
+	pid, err := ioutil.ReadFile(dir + "/pid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(string(pid)))
+	time.Sleep(100 * time.Millisecond)
+	if n == 0 || alive(n) {
+		t.Errorf("expected server session's sleep %d to be killed", n)
+	}
+	var b strings.Builder
+	report.Print(&b)
+	for _, s := range []string{
+		"  session server:\n    PASS     2 ",
+		"  session client:\n    FAIL     7 ",
+		"  cleanup:\n    PASS     6 ",
+	} {
+		if !strings.Contains(b.String(), s) {
+			t.Errorf("expected %q in report\n%s", s, b.String())
+		}
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdrip-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ready := dir + "/ready"
+	blocks := []*program.BlockPgm{
+		makeBlock("(sleep 0.3; touch "+ready+") &\n").SetReadiness(
+			[]program.Readiness{{What: "file", Check: "[ -e " + ready + " ]"}},
+			2*time.Second, 100*time.Millisecond),
+		makeBlock("ls " + ready + "\n"),
+		makeBlock("echo hi\n").SetReadiness(
+			[]program.Readiness{{What: "never", Check: "false"}},
+			300*time.Millisecond, 100*time.Millisecond),
+		makeBlock("echo skipped\n")}
+	report := doIt(blocks)
+	checkFail(t, report, 2, StatusFailed, "mdrip: never not ready after 300ms")
+	if got := report.Lessons()[0].Blocks()[2].StdOut(); got != "hi\n" {
+		t.Errorf("unexpected stdout %q", got)
+	}
+}
+
+func TestCleanupRunsAfterFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdrip-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blocks := []*program.BlockPgm{
+		makeBlock("cd " + dir + "\nexport KALE=kale\nbeans() { echo beans; }\n"),
+		makeBlock("echo one > log\n").SetCleanup(true),
+		makeBlock("lochNessMonster\n"),
+		makeBlock("echo $KALE\nbeans\npwd\nlochNessMonster\n").SetCleanup(true),
+		makeBlock("echo three >> log\ncat log\n").SetCleanup(true),
+		makeBlock("echo skipped\n")}
+	report := doIt(blocks)
+	if report.Problem() == nil {
+		t.Fatalf("expected a problem")
+	}
+	l := report.Lessons()[0]
+	if len(l.Blocks()) != 3 || len(l.Cleanups()) != 3 {
+		t.Fatalf("expected 3 blocks and 3 cleanups, got %d and %d",
+			len(l.Blocks()), len(l.Cleanups()))
+	}
+	if s := l.Blocks()[2].Status(); s != StatusSkipped {
+		t.Errorf("expected last block skipped, got %v", s)
+	}
+	c := l.Cleanups()
+	want := []BlockStatus{StatusPassed, StatusFailed, StatusPassed}
+	for i, b := range c {
+		if b.Status() != want[i] {
+			t.Errorf("cleanup %d: got %v, want %v", i, b.Status(), want[i])
+		}
+	}
+	if got, want := c[1].StdOut(), "kale\nbeans\n"+dir+"\n"; got != want {
+		t.Errorf("cleanup didn't inherit the environment, got %q want %q", got, want)
+	}
+	if c[1].ExitCode() != 127 || c[1].Index() != 3 {
+		t.Errorf("unexpected cleanup report %+v", c[1])
+	}
+	if got := c[2].StdOut(); got != "one\nthree\n" {
+		t.Errorf("cleanups out of order, got %q", got)
+	}
+	if n := len(report.Failures()); n != 2 {
+		t.Errorf("expected two failures, got %d", n)
+	}
+}
+
+func TestCleanupSkippedForUnreachedLessons(t *testing.T) {
+	lessons := []*program.LessonPgm{
+		program.NewLessonPgm(base.FilePath("a"), []*program.BlockPgm{
+			makeBlock("echo a\n").SetCleanup(true),
+			makeBlock("lochNessMonster\n")}),
+		program.NewLessonPgm(base.FilePath("b"), []*program.BlockPgm{
+			makeBlock("echo b\n"),
+			makeBlock("echo b\n").SetCleanup(true)})}
+	report := NewSubshell(timeout, program.NewProgram(lessons)).Run()
+	if s := report.Lessons()[0].Cleanups()[0].Status(); s != StatusPassed {
+		t.Errorf("expected first lesson cleaned up, got %v", s)
+	}
+	if s := report.Lessons()[1].Cleanups()[0].Status(); s != StatusSkipped {
+		t.Errorf("expected second lesson cleanup skipped, got %v", s)
+	}
+}
+
+// alive is true if the process with the given pid exists, and
+// isn't a zombie.
+func alive(pid int) bool {
+	out, err := exec.Command(
+		"/bin/ps", "-o", "stat=", "-p", strconv.Itoa(pid)).Output()
+	return err == nil && !strings.HasPrefix(string(out), "Z")
+}
+
+func TestFailureKillsBackgroundProcesses(t *testing.T) {
+	blocks := []*program.BlockPgm{
+		makeBlock("sleep 97 >/dev/null 2>&1 &\n"),
+		makeBlock("lochNessMonster\n")}
+	report := doIt(blocks)
+	checkFail(t, report, 1, StatusFailed, "lochNessMonster: command not found")
+	killed := report.Failures()[0].Killed()
+	if len(killed) != 1 || killed[0].Command != "sleep 97" {
+		t.Fatalf("expected sleep to be killed, got %v", killed)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if alive(killed[0].Pid) {
+		t.Errorf("process %v still alive", killed[0])
+	}
+}
+
+func TestTimeOutKillsBlockBeforeCleanup(t *testing.T) {
+	start := time.Now()
+	blocks := []*program.BlockPgm{
+		makeBlock("export KALE=kale\n"),
+		makeBlock("sleep 98\n"),
+		makeBlock("echo $KALE\n").SetCleanup(true)}
+	report := doIt(blocks)
+	if d := time.Since(start); d > timeout+killGrace {
+		t.Errorf("timed out block apparently not killed, took %v", d)
+	}
+	f := report.Lessons()[0].Blocks()[1]
+	if f.Status() != StatusTimedOut {
+		t.Errorf("expected timeout, got %v", f.Status())
+	}
+	if len(f.Killed()) != 1 || f.Killed()[0].Command != "sleep 98" {
+		t.Errorf("expected sleep to be killed, got %v", f.Killed())
+	}
+	c := report.Lessons()[0].Cleanups()[0]
+	if c.Status() != StatusPassed || c.StdOut() != "kale\n" {
+		t.Errorf("unexpected cleanup %v %q", c.Status(), c.StdOut())
+	}
+}
+
+func TestBlockTimeouts(t *testing.T) {
+	blocks := []*program.BlockPgm{
+		// Quiet, but given long enough.
+		makeBlock("sleep 3\n").SetTimeout(4 * time.Second),
+		// Chatty, but not done within the default.
+		makeBlock("for i in 1 2 3 4 5 6; do echo $i; sleep 0.5; done\n"),
+		makeBlock("echo skipped\n")}
+	report := doIt(blocks)
+	checkFail(t, report, 1, StatusTimedOut, "block timed out after 2s")
+	if got := report.Failures()[0].StdOut(); !strings.HasPrefix(got, "1\n2\n") {
+		t.Errorf("expected output before the timeout, got %q", got)
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	blocks := []*program.BlockPgm{
+		makeBlock("sleep 0.6\n"),
+		makeBlock("sleep 0.6\n"),
+		makeBlock("echo skipped\n"),
+		makeBlock("sleep 0.6\necho clean\n").SetCleanup(true)}
+	lesson := program.NewLessonPgm(base.FilePath("foo"), blocks)
+	p := program.NewProgram([]*program.LessonPgm{lesson})
+	report := NewSubshell(timeout, p).SetRunTimeout(time.Second).Run()
+	checkFail(t, report, 1, StatusTimedOut, "run timed out (limit 1s)")
+	if c := report.Lessons()[0].Cleanups()[0]; c.Status() != StatusPassed {
+		t.Errorf("expected cleanup to run, got %v", c.Status())
+	}
+}
+
+func TestOutputThatWouldConfuseSentinels(t *testing.T) {
+	blocks := []*program.BlockPgm{
+		makeBlock("printf 'no newline'\n"),
+		makeBlock("exec 7>&1 >/dev/null\necho hidden\n"),
+		makeBlock("echo hidden too\nexec >&7\necho back\n"),
+		makeBlock("(sleep 0.3; echo late) &\n"),
+		makeBlock("sleep 0.6\necho next\n")}
+	report := doIt(blocks)
+	if report.Problem() != nil {
+		t.Fatalf("unexpected problem: %v", report.Problem())
+	}
+	got := report.Lessons()[0].Blocks()
+	for i, want := range []string{"no newline", "", "back\n", "", "late\nnext\n"} {
+		if got[i].StdOut() != want {
+			t.Errorf("block %d: got %q, want %q", i, got[i].StdOut(), want)
+		}
+	}
+}
+
+func TestLanguages(t *testing.T) {
+	blocks := []*program.BlockPgm{
+		makeBlock("export KALE=kale\n"),
+		makeBlock("import os\nprint(os.environ['KALE'])\n").SetLanguage("python"),
+		makeBlock("kale: true\n").SetLanguage("yaml"),
+		makeBlock("cd /tmp && export BEANS=beans\n").SetLanguage("sh"),
+		makeBlock("echo $BEANS in $PWD\n"),
+		makeBlock("package main\nfunc main() { println(\"gopher\") }\n").SetLanguage("go"),
+		makeBlock("import sys\nsys.exit(3)\n").SetLanguage("python"),
+		makeBlock("echo skipped\n")}
+	lesson := program.NewLessonPgm(base.FilePath("foo"), blocks)
+	p := program.NewProgram([]*program.LessonPgm{lesson})
+	report := NewSubshell(30*time.Second, p).Run()
+	got := report.Lessons()[0].Blocks()
+	want := []BlockStatus{
+		StatusPassed, StatusPassed, StatusSkipped, StatusPassed,
+		StatusPassed, StatusPassed, StatusFailed, StatusSkipped}
+	for i, b := range got {
+		if b.Status() != want[i] {
+			t.Errorf("block %d: got %v, want %v", i, b.Status(), want[i])
+		}
+	}
+	if got[1].StdOut() != "kale\n" {
+		t.Errorf("python didn't see the environment, got %q", got[1].StdOut())
+	}
+	if got[2].Message() != `no interpreter for language "yaml"` {
+		t.Errorf("unexpected note %q", got[2].Message())
+	}
+	if got[4].StdOut() != "beans in /tmp\n" {
+		t.Errorf("sh block didn't change the shell, got %q", got[4].StdOut())
+	}
+	if got[5].StdErr() != "gopher\n" {
+		t.Errorf("go block didn't run, got %q", got[5].StdErr())
+	}
+	if got[6].ExitCode() != 3 {
+		t.Errorf("expected exit code 3, got %d", got[6].ExitCode())
+	}
+}
+
+func TestTrailingProseIsNotReported(t *testing.T) {
+	blocks := lexer.Parse("Intro.\n\n<!-- @hello -->\n```\necho hi\n```\n\nThe end.\n")
+	if len(blocks) != 2 {
+		t.Fatalf("expected a block and trailing prose, got %d blocks", len(blocks))
+	}
+	tut := model.NewLessonTutFromBlockParsed(base.FilePath("foo.md"), blocks)
+	report := NewSubshell(timeout,
+		program.NewProgramFromTutorial(base.WildCardLabel, tut)).Run()
+	if report.Problem() != nil {
+		t.Fatalf("unexpected problem: %v", report.Problem())
+	}
+	got := report.Lessons()[0].AllBlocks()
+	if len(got) != 1 || got[0].Name() != "hello" {
+		t.Fatalf("expected just block hello, got %d blocks", len(got))
+	}
+	if n := report.Count(StatusPassed); n != 1 {
+		t.Errorf("expected 1 passed, got %d", n)
+	}
+	var w strings.Builder
+	report.Print(&w)
+	if strings.Contains(w.String(), " 2 ") {
+		t.Errorf("trailing prose reported as a block:\n%s", w.String())
+	}
+}
+
+func TestSessionTranscripts(t *testing.T) {
+	session := func(code string) *program.BlockPgm {
+		b := model.NewBlockParsed([]base.Label{}, base.NoProse(), base.OpaqueCode(code))
+		b.SetLanguage("console")
+		return program.NewBlockPgmFromBlockTut(model.NewBlockTut(b))
+	}
+	blocks := []*program.BlockPgm{
+		session("$ export KALE=kale\n$ echo $KALE\nkale\n"),
+		session("$ echo started at $(date +%s)\nstarted at ...\n$ seq 5\n1\n...\n5\n"),
+		session("$ echo beans\nrice\n")}
+	report := doIt(blocks)
+	got := report.Lessons()[0].Blocks()
+	want := []BlockStatus{StatusPassed, StatusPassed, StatusFailed}
+	for i, b := range got {
+		if b.Status() != want[i] {
+			t.Errorf("block %d: got %v (%s), want %v", i, b.Status(), b.Message(), want[i])
+		}
+	}
+	if !strings.Contains(got[2].Message(), "-rice\n+beans\n") {
+		t.Errorf("expected a diff, got %q", got[2].Message())
+	}
+}
+
+func TestEnv(t *testing.T) {
+	os.Setenv("MDRIP_TEST_OUTER", "outer")
+	defer os.Unsetenv("MDRIP_TEST_OUTER")
+	code := "echo \"$A|$B|${MDRIP_TEST_OUTER:-gone}\"\n"
+	tests := []struct {
+		clean  bool
+		stdOut string
+		env    []string
+		print  string
+	}{
+		{false, "2|x y|outer\n", []string{"A=2", "B=x y"},
+			"inherited environment, plus:\n  A=2\n  B=x y\n"},
+		{true, "2|x y|gone\n", []string{"A=2", "B=x y"},
+			"clean environment:\n  A=2\n  B=x y\n"},
+	}
+	for _, test := range tests {
+		lesson := program.NewLessonPgm(
+			base.FilePath("foo"), []*program.BlockPgm{makeBlock(code)})
+		s := NewSubshell(timeout, program.NewProgram([]*program.LessonPgm{lesson})).
+			AddEnv("A=1", "B=x y", "A=2")
+		if test.clean {
+			s.SetCleanEnv([]string{"NOT_SET_ANYWHERE"})
+		}
+		report := s.Run()
+		if report.Problem() != nil {
+			t.Fatalf("unexpected problem: %v", report.Problem())
+		}
+		if got := report.Lessons()[0].Blocks()[0].StdOut(); got != test.stdOut {
+			t.Errorf("got stdout %q, want %q", got, test.stdOut)
+		}
+		if !reflect.DeepEqual(report.Env(), test.env) || report.CleanEnv() != test.clean {
+			t.Errorf("got env %v (clean %v), want %v", report.Env(), report.CleanEnv(), test.env)
+		}
+		var w strings.Builder
+		report.Print(&w)
+		if !strings.HasPrefix(w.String(), test.print) {
+			t.Errorf("expected report to start with %q, got\n%s", test.print, w.String())
+		}
+	}
+}
+
+func TestReadEnvFile(t *testing.T) {
+	tests := []struct {
+		content string
+		env     []string
+		err     string
+	}{
+		{"# settings\n\nA=1\nexport B=\"two words\"\n  C='x'\nD=\nE=a=b\n",
+			[]string{"A=1", "B=two words", "C=x", "D=", "E=a=b"}, ""},
+		{"A=1\nnot a setting\n", nil,
+			":2: expecting NAME=value, got \"not a setting\""},
+	}
+	for _, test := range tests {
+		f, err := ioutil.TempFile("", "mdrip-env-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		f.WriteString(test.content)
+		f.Close()
+		env, err := ReadEnvFile(f.Name())
+		if test.err != "" {
+			if err == nil || !strings.HasSuffix(err.Error(), test.err) {
+				t.Errorf("got error %v, want one ending %q", err, test.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(env, test.env) {
+			t.Errorf("got %q, %v, want %q", env, err, test.env)
+		}
+	}
 }
@@ -0,0 +1,80 @@
+package subshell
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// TapListener streams results in TAP version 13, one test point
+// per block.
+type TapListener struct {
+	w io.Writer
+	n int
+}
+
+func NewTapListener(w io.Writer) *TapListener {
+	return &TapListener{w, 0}
+}
+
+func (x *TapListener) RunStarted(r *RunReport) {
+	total := 0
+	for _, l := range r.Lessons() {
+		total += len(l.AllBlocks())
+	}
+	fmt.Fprintf(x.w, "TAP version 13\n1..%d\n", total)
+}
+
+func (x *TapListener) BlockStarted(b *BlockReport) {}
+
+func (x *TapListener) BlockOutput(b *BlockReport, s Stream, line string) {}
+
+func (x *TapListener) BlockFinished(b *BlockReport) {
+	x.n++
+	desc := fmt.Sprintf("%d - %s %s", x.n, b.FileName(), b.Name())
+	if b.Block().IsCleanup() {
+		desc += " (cleanup)"
+	}
+	switch {
+	case b.Status() == StatusSkipped:
+		if len(b.Message()) > 0 {
+			desc += " # SKIP " + b.Message()
+		} else {
+			desc += " # SKIP"
+		}
+		fmt.Fprintf(x.w, "ok %s\n", desc)
+	case b.Failed():
+		fmt.Fprintf(x.w, "not ok %s\n", desc)
+		fmt.Fprintf(x.w, "  ---\n")
+		fmt.Fprintf(x.w, "  status: %s\n", b.Status())
+		fmt.Fprintf(x.w, "  exitCode: %d\n", b.ExitCode())
+		fmt.Fprintf(x.w, "  durationMs: %d\n", b.Duration().Milliseconds())
+		writeTapYamlBlock(x.w, "message", b.Message())
+		writeTapYamlBlock(x.w, "stdout", b.StdOut())
+		writeTapYamlBlock(x.w, "stderr", b.StdErr())
+		writeTapYamlBlock(x.w, "killed", describeKilled(b.Killed()))
+		fmt.Fprintf(x.w, "  ...\n")
+	default:
+		fmt.Fprintf(x.w, "ok %s\n", desc)
+	}
+}
+
+func (x *TapListener) LessonFinished(l *LessonReport) {
+	fmt.Fprintf(x.w, "# %s: %d passed, %d failed, %d skipped\n",
+		l.Path(), l.Count(StatusPassed),
+		l.Count(StatusFailed)+l.Count(StatusTimedOut), l.Count(StatusSkipped))
+}
+
+func (x *TapListener) RunFinished(r *RunReport) {}
+
+// writeTapYamlBlock writes output as a YAML literal block scalar.
+func writeTapYamlBlock(w io.Writer, key, output string) {
+	output = strings.TrimRight(output, "\n")
+	if len(output) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "  %s: |\n", key)
+	for _, line := range strings.Split(output, "\n") {
+		fmt.Fprintf(w, "    %s\n", line)
+	}
+}
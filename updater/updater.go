@@ -0,0 +1,102 @@
+// Package updater rewrites the expected output fences in markdown
+// files with the output actually produced by their command blocks.
+package updater
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/monopole/mdrip/base"
+	"github.com/monopole/mdrip/subshell"
+	"github.com/monopole/mdrip/util"
+)
+
+// edit replaces the bytes in span, old once unindented, with text,
+// indented likewise.
+type edit struct {
+	span   base.Span
+	old    string
+	text   string
+	indent int
+}
+
+// Update rewrites, in place, every file in the report that has a
+// block with an exact-match output fence, replacing the fence's
+// content with the block's captured stdout.  Only blocks that ran to
+// completion are considered.  Only exact-match fences are rewritten;
+// those holding a pattern, whether a regexp, a "contains" substring
+// or lines with ellipses, are left alone, as is every byte outside
+// the fences.
+//
+// Returns the files that changed.
+func Update(r *subshell.RunReport) ([]base.FilePath, error) {
+	changed := []base.FilePath{}
+	for _, l := range r.Lessons() {
+		edits := []edit{}
+		for _, b := range l.AllBlocks() {
+			e := b.Block().Expected()
+			if e == nil || e.Mode() != base.MatchExact ||
+				e.Span().Start < 0 || !b.Completed() {
+				continue
+			}
+			text, err := asFenceBody(b.StdOut(), e.Fence())
+			if err != nil {
+				return changed, fmt.Errorf("block %d (%s) at %s: %v",
+					b.Index()+1, b.Name(), b.Where(), err)
+			}
+			if text != e.Text() {
+				edits = append(edits, edit{e.Span(), e.Text(), text, e.Indent()})
+			}
+		}
+		if len(edits) == 0 {
+			continue
+		}
+		if err := rewrite(l.Path(), edits); err != nil {
+			return changed, err
+		}
+		changed = append(changed, l.Path())
+	}
+	return changed, nil
+}
+
+// asFenceBody converts captured output into something that can sit
+// between the given fences, failing if a line of it would close them.
+func asFenceBody(output string, f base.Fence) (string, error) {
+	for _, line := range strings.Split(output, "\n") {
+		if f.ClosedBy(line) {
+			return "", fmt.Errorf("output line %q would close its %s fence", line, f)
+		}
+	}
+	if len(output) > 0 && !strings.HasSuffix(output, "\n") {
+		output += "\n"
+	}
+	return output, nil
+}
+
+// rewrite applies the edits to the file.  The file must not have
+// changed since it was parsed, i.e. each span must still hold the
+// old text.
+func rewrite(path base.FilePath, edits []edit) error {
+	contents, err := path.Read()
+	if err != nil {
+		return err
+	}
+	sort.Slice(edits, func(i, j int) bool {
+		return edits[i].span.Start > edits[j].span.Start
+	})
+	for _, e := range edits {
+		if e.span.End > len(contents) ||
+			util.Dedent(contents[e.span.Start:e.span.End], e.indent) != e.old {
+			return fmt.Errorf("%s changed during the run; not updating it", path)
+		}
+		contents = contents[:e.span.Start] + util.Indent(e.text, e.indent) + contents[e.span.End:]
+	}
+	info, err := os.Stat(string(path))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(string(path), []byte(contents), info.Mode())
+}
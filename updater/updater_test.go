@@ -0,0 +1,142 @@
+package updater
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/monopole/mdrip/base"
+	"github.com/monopole/mdrip/lexer"
+	"github.com/monopole/mdrip/model"
+	"github.com/monopole/mdrip/program"
+	"github.com/monopole/mdrip/subshell"
+)
+
+const (
+	original = "# Title\n\n" +
+		"```\necho hello\necho world\n```\n\n" +
+		"\n```output\nstale\n```\n\n" +
+		"```\ndate\n```\n\n" +
+		"```output regexp\n[0-9]\n```\n\n" +
+		"```\necho empty\n```\n" +
+		"```output\n```\n" +
+		"```\nprintf bare\n```\n" +
+		"```output\n```\n" +
+		"1. In a list:\n\n   ~~~\n   echo one; echo '  two'\n   ~~~\n" +
+		"   ~~~output\n   stale\n   ~~~\n" +
+		"Trailing  text\r\n"
+	updated = "# Title\n\n" +
+		"```\necho hello\necho world\n```\n\n" +
+		"\n```output\nhello\nworld\n```\n\n" +
+		"```\ndate\n```\n\n" +
+		"```output regexp\n[0-9]\n```\n\n" +
+		"```\necho empty\n```\n" +
+		"```output\nempty\n```\n" +
+		"```\nprintf bare\n```\n" +
+		"```output\nbare\n```\n" +
+		"1. In a list:\n\n   ~~~\n   echo one; echo '  two'\n   ~~~\n" +
+		"   ~~~output\n   one\n     two\n   ~~~\n" +
+		"Trailing  text\r\n"
+)
+
+func runFile(t *testing.T, path base.FilePath) *subshell.RunReport {
+	contents, err := path.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tut := model.NewLessonTutFromBlockParsed(path, lexer.Parse(contents))
+	p := program.NewProgramFromTutorial(base.WildCardLabel, tut)
+	return subshell.NewSubshell(2*time.Second, p).Run()
+}
+
+func TestUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "updater-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := base.FilePath(filepath.Join(dir, "x.md"))
+	if err := ioutil.WriteFile(string(path), []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := Update(runFile(t, path))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(changed) != 1 || changed[0] != path {
+		t.Errorf("expected %s to change, got %v", path, changed)
+	}
+	got, _ := path.Read()
+	if got != updated {
+		t.Errorf("got\n%q\nwant\n%q", got, updated)
+	}
+	// A second pass should find nothing to do.
+	report := runFile(t, path)
+	if report.Problem() != nil {
+		t.Errorf("updated file should pass, got %v", report.Problem())
+	}
+	changed, err = Update(report)
+	if err != nil || len(changed) != 0 {
+		t.Errorf("expected no changes, got %v, %v", changed, err)
+	}
+}
+
+func TestUpdateFences(t *testing.T) {
+	tests := []struct {
+		fence  string
+		output string
+		err    string // If empty, the fence is updated to hold output.
+	}{
+		{"~~~", "~~~", "output line \"~~~\" would close its ~~~ fence"},
+		{"~~~", "~~~~~", "output line \"~~~~~\" would close its ~~~ fence"},
+		{"~~~", "```", ""},
+		{"~~~", "~~~ not a fence", ""},
+		{"````", "```", ""},
+		{"````", "````", "output line \"````\" would close its ```` fence"},
+		{"````", "`````", "output line \"`````\" would close its ```` fence"},
+		{"```", "   ```", "output line \"   ```\" would close its ``` fence"},
+		{"```", "    ```", ""},
+		{"```", "~~~", ""},
+	}
+	dir, err := ioutil.TempDir("", "updater-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, test := range tests {
+		md := func(body string) string {
+			return "```\nprintf '%s\\n' '" + test.output + "'\n```\n\n" +
+				test.fence + "output\n" + body + test.fence + "\n"
+		}
+		path := base.FilePath(filepath.Join(dir, "x.md"))
+		if err := ioutil.WriteFile(string(path), []byte(md("stale\n")), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := Update(runFile(t, path))
+		got, _ := path.Read()
+		if test.err != "" {
+			if err == nil || !strings.HasSuffix(err.Error(), test.err) {
+				t.Errorf("%s fence, output %q: got error %v, want %q",
+					test.fence, test.output, err, test.err)
+			}
+			if got != md("stale\n") {
+				t.Errorf("%s fence, output %q: file changed to\n%s",
+					test.fence, test.output, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s fence, output %q: unexpected error %v", test.fence, test.output, err)
+		}
+		if want := md(test.output + "\n"); got != want {
+			t.Errorf("%s fence: got\n%s\nwant\n%s", test.fence, got, want)
+		}
+		if report := runFile(t, path); report.Problem() != nil {
+			t.Errorf("%s fence, output %q: updated file fails: %v",
+				test.fence, test.output, report.Problem())
+		}
+	}
+}
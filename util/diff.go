@@ -0,0 +1,141 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+)
+
+// UnifiedDiff returns a unified diff (with three lines of context)
+// that turns the lines of a into the lines of b, or the empty string
+// if they're the same.
+func UnifiedDiff(nameA, nameB, a, b string) string {
+	x := splitLines(a)
+	y := splitLines(b)
+	ops := diffLines(x, y)
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", nameA, nameB)
+	changed := false
+	const context = 3
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		changed = true
+		// Find the extent of this hunk, absorbing nearby changes.
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(ops) && ops[run].kind == ' ' {
+				run++
+			}
+			if run == len(ops) || run-end > 2*context {
+				end += context
+				if end > run {
+					end = run
+				}
+				break
+			}
+			end = run
+		}
+		writeHunk(&out, ops[start:end])
+		i = end
+	}
+	if !changed {
+		return ""
+	}
+	return out.String()
+}
+
+type diffOp struct {
+	kind rune // ' ', '-' or '+'
+	line string
+	ai   int // line number in a (zero-relative) of ' ' and '-' ops
+	bi   int // line number in b (zero-relative) of ' ' and '+' ops
+}
+
+func writeHunk(out *strings.Builder, ops []diffOp) {
+	aStart, bStart, aLen, bLen := -1, -1, 0, 0
+	for _, op := range ops {
+		if op.kind != '+' {
+			if aStart < 0 {
+				aStart = op.ai
+			}
+			aLen++
+		}
+		if op.kind != '-' {
+			if bStart < 0 {
+				bStart = op.bi
+			}
+			bLen++
+		}
+	}
+	fmt.Fprintf(out, "@@ -%s +%s @@\n",
+		hunkRange(aStart, aLen, ops[0].ai), hunkRange(bStart, bLen, ops[0].bi))
+	for _, op := range ops {
+		fmt.Fprintf(out, "%c%s\n", op.kind, op.line)
+	}
+}
+
+func hunkRange(start, n, fallback int) string {
+	if start < 0 {
+		start = fallback
+	} else {
+		start++
+	}
+	return fmt.Sprintf("%d,%d", start, n)
+}
+
+func splitLines(s string) []string {
+	s = strings.TrimRight(s, "\n")
+	if len(s) == 0 {
+		return []string{}
+	}
+	return strings.Split(s, "\n")
+}
+
+// diffLines computes an edit script via longest common subsequence.
+// Quadratic, but inputs are the output of command blocks.
+func diffLines(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	ops := []diffOp{}
+	i, j := 0, 0
+	for i < n || j < m {
+		switch {
+		case i < n && j < m && a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i], i, j})
+			i++
+			j++
+		case j < m && (i == n || lcs[i][j+1] > lcs[i+1][j]):
+			ops = append(ops, diffOp{'+', b[j], i, j})
+			j++
+		default:
+			ops = append(ops, diffOp{'-', a[i], i, j})
+			i++
+		}
+	}
+	return ops
+}
@@ -0,0 +1,32 @@
+package util
+
+import (
+	"testing"
+)
+
+type difftest struct {
+	name string
+	a    string
+	b    string
+	want string
+}
+
+var difftests = []difftest{
+	{"same", "a\nb\n", "a\nb", ""},
+	{"empty", "", "", ""},
+	{"change", "a\nb\nc\n", "a\nx\nc\n",
+		"--- want\n+++ got\n@@ -1,3 +1,3 @@\n a\n-b\n+x\n c\n"},
+	{"add", "", "x\n",
+		"--- want\n+++ got\n@@ -0,0 +1,1 @@\n+x\n"},
+	{"context", "1\n2\n3\n4\n5\n6\n7\n8\n9\n", "1\n2\n3\n4\n5\n6\n7\n8\nX\n",
+		"--- want\n+++ got\n@@ -6,4 +6,4 @@\n 6\n 7\n 8\n-9\n+X\n"},
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	for _, test := range difftests {
+		got := UnifiedDiff("want", "got", test.a, test.b)
+		if got != test.want {
+			t.Errorf("%s:\ngot\n\"%s\"\nwant\n\"%s\"\n", test.name, got, test.want)
+		}
+	}
+}
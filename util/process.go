@@ -0,0 +1,65 @@
+package util
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Process describes a running process.
+type Process struct {
+	Pid     int
+	Command string
+}
+
+func (p Process) String() string {
+	return fmt.Sprintf("%d %s", p.Pid, p.Command)
+}
+
+// ProcessesInGroup returns the live (i.e. non-zombie) processes in
+// the given process group.
+func ProcessesInGroup(pgid int) ([]Process, error) {
+	cmdOut, err := exec.Command(
+		"/bin/ps", "-e", "-o", "pgid=,pid=,stat=,args=").Output()
+	if err != nil {
+		return nil, err
+	}
+	result := []Process{}
+	for _, line := range strings.Split(string(cmdOut), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] != strconv.Itoa(pgid) ||
+			strings.HasPrefix(fields[2], "Z") {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		result = append(result, Process{pid, strings.Join(fields[3:], " ")})
+	}
+	return result, nil
+}
+
+// KillProcessGroup sends TERM to every process in the given group,
+// then, after the grace period, KILL to any that remain.  It returns
+// the processes that were alive before the TERM.
+func KillProcessGroup(pgid int, grace time.Duration) []Process {
+	procs, _ := ProcessesInGroup(pgid)
+	if len(procs) == 0 {
+		return procs
+	}
+	if err := syscall.Kill(-pgid, syscall.SIGTERM); err != nil {
+		return procs
+	}
+	for deadline := time.Now().Add(grace); time.Now().Before(deadline); {
+		time.Sleep(100 * time.Millisecond)
+		if alive, err := ProcessesInGroup(pgid); err == nil && len(alive) == 0 {
+			return procs
+		}
+	}
+	syscall.Kill(-pgid, syscall.SIGKILL)
+	return procs
+}
@@ -4,37 +4,11 @@ import (
 	"fmt"
 	"github.com/golang/glog"
 	"github.com/pkg/errors"
-	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
 )
 
-// getProcessGroupId purports to get a process group Id common to all
-// subprocesses of its pid argument.
-//
-// There should be a better way to do this.
-//
-// Goal is to be able to support killing any subprocesses created by
-// RunInSubShell.  At the moment, its up to authors to clean up after
-// themselves.
-func GetProcesssGroupId(pid int) (int, error) {
-	//  /bin/ps -o pid,pgid,rgid,ppid,cmd
-	//  /bin/ps -o pgid=12492 --no-headers
-	cmdOut, execErr := exec.Command(
-		"/bin/ps", "--pid", strconv.Itoa(pid), "-o", "pgid", "--no-headers").Output()
-	groupId := strings.TrimSpace(string(cmdOut))
-	if execErr != nil || len(groupId) < 1 {
-		return 0, errors.New(
-			"Unable to yank groupId from ps command: " + groupId + " " + execErr.Error())
-	}
-	pgid, convErr := strconv.Atoi(groupId)
-	if convErr != nil {
-		return 0, convErr
-	}
-	return pgid, nil
-}
-
 // check reports the error fatally if it's non-nil.
 func Check(msg string, err error) {
 	if err != nil {
@@ -42,12 +16,6 @@ func Check(msg string, err error) {
 	}
 }
 
-// An attempt to kill any and all child processes.
-func killProcesssGroup(pgid int) {
-	killer := exec.Command("/bin/kill", "-TERM", "--", fmt.Sprintf("-%v", pgid))
-	killer.Start()
-}
-
 // Convert tabs, newlines, etc. to normal blanks.
 func convertBadWhiteSpaceToBlanks(s string) string {
 	return strings.Map(func(r rune) rune {
@@ -62,6 +30,19 @@ func convertBadWhiteSpaceToBlanks(s string) string {
 
 var leading = regexp.MustCompile("^[0-9]+_")
 
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// SplitEnv splits a setting like NAME=value into its name and value,
+// failing if there's no = or the name isn't that of an environment
+// variable.
+func SplitEnv(s string) (name, value string, ok bool) {
+	i := strings.IndexByte(s, '=')
+	if i < 0 || !envName.MatchString(s[:i]) {
+		return "", "", false
+	}
+	return s[:i], s[i+1:], true
+}
+
 // Drop leading numbers and underscores.
 func DropLeadingNumbers(s string) string {
 	r := leading.FindStringIndex(s)
@@ -87,3 +68,38 @@ func Spaces(n int) string {
 	}
 	return fmt.Sprintf("%"+strconv.Itoa(n)+"s", " ")
 }
+
+// Dedent removes up to n leading spaces from every line of s.
+func Dedent(s string, n int) string {
+	if n < 1 {
+		return s
+	}
+	lines := strings.SplitAfter(s, "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimLeft(line, " ")
+		if len(line)-len(trimmed) > n {
+			trimmed = line[n:]
+		}
+		lines[i] = trimmed
+	}
+	return strings.Join(lines, "")
+}
+
+// Indent adds n leading spaces to every non-blank line of s.
+func Indent(s string, n int) string {
+	if n < 1 {
+		return s
+	}
+	lines := strings.SplitAfter(s, "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) != "" {
+			lines[i] = Spaces(n) + line
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// ShellQuote returns s single quoted for bash.
+func ShellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -48,3 +48,14 @@ func TestDropLeadingSorter(t *testing.T) {
 		}
 	}
 }
+
+func TestDedentAndIndent(t *testing.T) {
+	in := "   a\n     b\n c\n\n   d"
+	want := "a\n  b\nc\n\nd"
+	if got := Dedent(in, 3); got != want {
+		t.Errorf("Dedent: got %q, want %q", got, want)
+	}
+	if got, want := Indent(want, 2), "  a\n    b\n  c\n\n  d"; got != want {
+		t.Errorf("Indent: got %q, want %q", got, want)
+	}
+}
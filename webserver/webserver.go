@@ -248,8 +248,8 @@ func (ws *Server) showDebugPage(w http.ResponseWriter, r *http.Request) {
 	for i, lesson := range p.Lessons() {
 		fmt.Fprintf(w, "file %d: %s\n", i, lesson.Path())
 		for j, b := range lesson.Blocks() {
-			fmt.Fprintf(w, "  block %d, content: %s\n",
-				j, util.SampleString(b.Code().String(), 50))
+			fmt.Fprintf(w, "  block %d at %s, content: %s\n",
+				j, b.Location().InFile(lesson.Path()), util.SampleString(b.Code().String(), 50))
 		}
 	}
 }
@@ -259,7 +259,7 @@ func (ws *Server) attemptTmuxWrite(b *program.BlockPgm) error {
 	if !t.IsUp() {
 		return errors.New("No local tmux to write to.")
 	}
-	_, err := t.Write(b.Code().Bytes())
+	_, err := t.Write([]byte(b.Commands()))
 	return err
 }
 
@@ -309,7 +309,7 @@ func (ws *Server) makeBlockRunner() func(w http.ResponseWriter, r *http.Request)
 		if c == nil {
 			glog.Infof("no socket for session %v", sessId)
 		} else {
-			_, err := c.Write(block.Code().Bytes())
+			_, err := c.Write([]byte(block.Commands()))
 			if err != nil {
 				glog.Infof("socket write failed: %v", err)
 				delete(ws.connections, sessId)